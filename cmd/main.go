@@ -1,15 +1,25 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/dikaeinstein/go-graphql-api/config"
 	"github.com/dikaeinstein/go-graphql-api/data/postgres"
 	"github.com/dikaeinstein/go-graphql-api/gql"
 	"github.com/dikaeinstein/go-graphql-api/graphqlws"
+	"github.com/dikaeinstein/go-graphql-api/logger"
 	"github.com/dikaeinstein/go-graphql-api/pubsub"
+	"github.com/dikaeinstein/go-graphql-api/pubsub/pgnotify"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/gorilla/websocket"
@@ -18,54 +28,282 @@ import (
 	_ "github.com/lib/pq"
 )
 
-// Time to wait before force close on connection.
+// Time a client has to answer a close frame before the connection is dropped.
 const closeGracePeriod = 10 * time.Second
 
+// Messages per second and burst size allowed on a websocket connection.
+const (
+	wsMessageRate  = 20
+	wsMessageBurst = 40
+)
+
+const usage = `Usage: go-graphql-api [flags] [command]
+
+Commands:
+  serve            start the API server (default)
+  migrate up       apply all pending migrations
+  migrate down N   roll back the last N migrations
+  migrate status   list migrations and whether they are applied
+  seed             insert the development fixture data
+  config           print the effective configuration, secrets redacted
+
+Flags override environment variables, which override the config file:
+`
+
 func main() {
-	cfg := config.New()
-	db := connectPostgresDB(cfg)
-	defer db.Close()
+	fs := flag.NewFlagSet("go-graphql-api", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	cfg, err := config.Load(fs, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	args := fs.Args()
+	log := newLogger(cfg)
+	if !cfg.DotEnvLoaded {
+		log.Debug(".env not found, using the process environment")
+	}
+
+	command := "serve"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "serve":
+		serve(cfg, log)
+	case "migrate":
+		db := connectPostgresDB(cfg, log)
+		defer db.Close()
+		if err := runMigrate(db, args[1:], log); err != nil {
+			fatal(log, "migrate failed", err)
+		}
+	case "seed":
+		db := connectPostgresDB(cfg, log)
+		defer db.Close()
+		if err := db.Seed(context.Background()); err != nil {
+			fatal(log, "seed failed", err)
+		}
+		log.Info("seed data inserted")
+	case "config":
+		fmt.Print(cfg)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// newLogger creates the logger of the server: JSON in production and
+// text otherwise.
+func newLogger(cfg config.Config) *logger.Logger {
+	level, _ := logger.ParseLevel(cfg.LogLevel)
+	format := logger.TextFormat
+	if cfg.AppEnv == "production" {
+		format = logger.JSONFormat
+	}
+	return logger.New(os.Stderr, level, format)
+}
+
+// fatal logs err and exits.
+func fatal(log *logger.Logger, msg string, err error) {
+	log.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func serve(cfg config.Config, log *logger.Logger) {
+	db := connectPostgresDB(cfg, log)
+
+	if cfg.DBMigrateOnStart {
+		if err := runMigrate(db, []string{"up"}, log); err != nil {
+			fatal(log, "migrate failed", err)
+		}
+	}
 
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestID, logger.Middleware(log))
 
-	ps := pubsub.NewInMemoryPubSub()
+	ps := newPubSub(cfg, db, log)
+	payloadTypes := pubsub.NewPayloadTypes(gql.EventPayloads()...)
+	relay := postgres.NewOutboxRelay(db, postgres.RelayConfig{
+		Publish: func(ctx context.Context, id int64, topic string, payload interface{}) error {
+			return ps.PublishContext(ctx, topic, graphqlws.LoggedEvent{ID: id, Payload: payload})
+		},
+		Decode:       payloadTypes.Decode,
+		PollInterval: cfg.OutboxPollInterval,
+		MaxAttempts:  cfg.OutboxMaxAttempts,
+		Retention:    cfg.OutboxRetention,
+		// the memory pubsub only reaches this server's subscribers
+		Local: cfg.PubSubDriver == "memory",
+	})
+	relay.Start()
 
-	schema := setupGraphQLSchema(db, ps)
+	root := gql.NewRoot(gql.NewResolver(db, log))
+	schema := setupGraphQLSchema(root, log)
 	graphql := setupGraphQLHandler(schema)
-	r.Handle("/graphql", graphql)
+	loaderConfig := gql.LoaderConfig{Wait: time.Millisecond, MaxBatch: 100}
+	r.With(gql.LoaderMiddleware(db, loaderConfig)).Handle("/graphql", graphql)
+	r.Handle("/debug/vars", expvar.Handler())
+
+	subManager := graphqlws.NewSubscriptionManager(&schema, ps, root.SubscriptionFields)
+	subManager.EventLog = eventLog{postgres.NewEventLog(db, payloadTypes.Decode, cfg.EventReplayLimit)}
+	r.Handle("/subscriptions", setupGraphQLWSHandler(subManager, log))
 
-	graphqlws := setupGraphQLWSHandler(schema, ps)
-	r.Handle("/subscriptions", graphqlws)
+	srv := &http.Server{Addr: cfg.ListenAddr(), Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Info("server listening", "addr", srv.Addr)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	failed := false
+	select {
+	case err := <-serverErr:
+		log.Error("server failed", "error", err)
+		failed = true
+	case sig := <-stop:
+		log.Info("shutting down", "signal", sig)
+	}
+	signal.Stop(stop)
 
-	log.Println("Server listening on port:", cfg.Port)
-	http.ListenAndServe(":6600", r)
+	shutdown(cfg, log, srv, subManager, relay, ps, db)
+	if failed {
+		os.Exit(1)
+	}
 }
 
-func connectPostgresDB(cfg config.Config) *postgres.Postgres {
-	connStr := postgres.ConnString(
+// shutdown stops accepting connections, drains the HTTP requests and
+// websocket clients until the shutdown timeout expires, then stops the
+// outbox relay and closes the pubsub and the database pool.
+func shutdown(cfg config.Config, log *logger.Logger, srv *http.Server,
+	subManager *graphqlws.SubscriptionManager, relay *postgres.OutboxRelay, ps pubSub, db *postgres.Postgres) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelFunc()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warn("failed to drain HTTP requests", "error", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := subManager.Shutdown(ctx); err != nil {
+			log.Warn("failed to drain websocket connections", "error", err)
+		}
+	}()
+	wg.Wait()
+
+	if err := relay.Close(); err != nil {
+		log.Warn("failed to stop outbox relay", "error", err)
+	}
+	if err := ps.Close(); err != nil {
+		log.Warn("failed to close pubsub", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		log.Warn("failed to close database", "error", err)
+	}
+	log.Info("server stopped")
+}
+
+// eventLog replays the events relayed from the outbox to the resuming
+// subscriptions.
+type eventLog struct {
+	log *postgres.EventLog
+}
+
+func (l eventLog) EventsAfter(ctx context.Context, topic string, id int64) ([]graphqlws.LoggedEvent, error) {
+	events, err := l.log.EventsAfter(ctx, topic, id)
+	if errors.Is(err, postgres.ErrEventsUnavailable) {
+		return nil, graphqlws.ErrResumeUnavailable
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logged := make([]graphqlws.LoggedEvent, len(events))
+	for i, e := range events {
+		logged[i] = graphqlws.LoggedEvent{ID: e.Seq, Payload: e.Payload}
+	}
+	return logged, nil
+}
+
+// pubSub is the publish and subscribe system of the server.
+type pubSub interface {
+	graphqlws.PubSub
+	PublishContext(ctx context.Context, event string, payload interface{}) error
+	Close() error
+}
+
+// newPubSub creates the pubsub selected by the pubsub_driver setting.
+func newPubSub(cfg config.Config, db *postgres.Postgres, log *logger.Logger) pubSub {
+	options := []pubsub.Option{
+		pubsub.Logger(log),
+		pubsub.BufferSize(cfg.PubSubBufferSize),
+		pubsub.DeliveryTimeout(cfg.PubSubDeliveryTimeout),
+	}
+	if cfg.PubSubDriver != "postgres" {
+		return pubsub.NewInMemoryPubSub(options...)
+	}
+
+	ps, err := pgnotify.New(db.DB, postgresConnString(cfg),
+		pgnotify.Channel(cfg.PubSubChannel),
+		pgnotify.Logger(log),
+		pgnotify.Types(gql.EventPayloads()...),
+		pgnotify.LocalOptions(options...),
+	)
+	if err != nil {
+		fatal(log, "failed to listen for events", err)
+	}
+	return ps
+}
+
+// postgresConnString returns the database URL, or a connection string
+// built from the db_* settings.
+func postgresConnString(cfg config.Config) string {
+	if cfg.DatabaseURL != "" {
+		return cfg.DatabaseURL
+	}
+	return postgres.ConnString(
 		cfg.DBName, cfg.DBUser,
-		postgres.ConnectTimeout(cfg.DBConnectTimeout),
-		postgres.SSLMode("disable"),
+		postgres.Host(cfg.DBHost),
+		postgres.Port(cfg.DBPort),
+		postgres.Password(cfg.DBPassword),
+		postgres.SSLMode(cfg.DBSSLMode),
+		postgres.ConnectTimeout(int(cfg.DBConnectTimeout/time.Second)),
 	)
-	postgresDB, err := postgres.New(connStr)
+}
+
+func connectPostgresDB(cfg config.Config, log *logger.Logger) *postgres.Postgres {
+	postgresDB, err := postgres.New(postgresConnString(cfg), postgres.PoolConfig{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	}, log)
 	if err != nil {
-		log.Fatalln(err)
+		fatal(log, "failed to connect to database", err)
 	}
 
 	return postgresDB
 }
 
-func setupGraphQLSchema(store gql.Store, pubsub graphqlws.PubSub) graphql.Schema {
-	resolver := gql.NewResolver(store, pubsub)
-	root := gql.NewRoot(resolver)
+func setupGraphQLSchema(root *gql.Root, log *logger.Logger) graphql.Schema {
 	schema, err := graphql.NewSchema(graphql.SchemaConfig{
 		Query:        root.Query,
 		Mutation:     root.Mutation,
 		Subscription: root.Subscription,
 	})
 	if err != nil {
-		log.Fatal(err)
+		fatal(log, "invalid graphQL schema", err)
 	}
 
 	return schema
@@ -80,36 +318,36 @@ func setupGraphQLHandler(schema graphql.Schema) http.Handler {
 	})
 }
 
-func setupGraphQLWSHandler(schema graphql.Schema, ps graphqlws.PubSub) http.Handler {
+func setupGraphQLWSHandler(subManager *graphqlws.SubscriptionManager, log *logger.Logger) http.Handler {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
-		Subprotocols: []string{"graphql-ws"},
+		Subprotocols: graphqlws.Subprotocols,
 	}
 
-	subManager := graphqlws.NewSubscriptionManager(&schema, ps)
-
 	eventHandlers := graphqlws.ConnectionEventHandlers{
-		Start: func(s *graphqlws.Subscription) {
-			subManager.AddSubscription(s)
-			log.Println("subscription added")
+		Start: func(s *graphqlws.Subscription) error {
+			if err := subManager.AddSubscription(s); err != nil {
+				return err
+			}
+			logger.FromContext(s.Context, log).Info("subscription added",
+				"subscription_id", s.SubscriberID)
+			return nil
 		},
-		Stop: func(subscriptionID string) {
-			subManager.RemoveSubscription(subscriptionID)
-			log.Println("subscription removed")
+		Stop: func(conn *websocket.Conn, operationID string) {
+			subManager.RemoveSubscription(conn, operationID)
+			log.Debug("subscription removed", "operation_id", operationID)
 		},
 		Close: func(conn *websocket.Conn) {
-			log.Println("closing graphQL client connection...")
-			time.Sleep(closeGracePeriod)
-			if err := conn.Close(); err != nil {
-				log.Println(err)
-			}
-			log.Println("connection closed")
+			log.Debug("closing graphQL client connection")
 		},
 	}
 
-	return graphqlws.NewHandler(upgrader, subManager, eventHandlers)
+	return graphqlws.NewHandler(upgrader, subManager, eventHandlers,
+		graphqlws.Logger(log),
+		graphqlws.CloseGracePeriod(closeGracePeriod),
+		graphqlws.RateLimit(wsMessageRate, wsMessageBurst))
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dikaeinstein/go-graphql-api/data/postgres"
+	"github.com/dikaeinstein/go-graphql-api/logger"
+)
+
+// runMigrate runs the `migrate` subcommand given its arguments.
+func runMigrate(db *postgres.Postgres, args []string, log *logger.Logger) error {
+	if len(args) == 0 {
+		return errors.New("migrate: expected one of up, down N or status")
+	}
+
+	migrator, err := postgres.NewMigrator(db, postgres.Migrations)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			log.Info("applied migration", "version", m.Version, "name", m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Info("no pending migrations")
+		}
+		return err
+	case "down":
+		if len(args) < 2 {
+			return errors.New("migrate down: expected number of migrations to roll back")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("migrate down: invalid number of migrations %q", args[1])
+		}
+		rolledBack, err := migrator.Down(ctx, n)
+		for _, m := range rolledBack {
+			log.Info("rolled back migration", "version", m.Version, "name", m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-30s %s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("migrate: unknown command %q", args[0])
+	}
+}
@@ -1,68 +1,421 @@
+// Package config loads the configuration of the server from defaults, an
+// optional YAML file, environment variables and command-line flags, in
+// increasing order of precedence.
 package config
 
 import (
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/dikaeinstein/go-graphql-api/logger"
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v2"
 )
 
 // Config is the configuration of the server.
 type Config struct {
-	AppEnv           string
+	AppEnv string
+	// Host and Port form the address the server listens on.
+	Host string
+	Port int
+	// DatabaseURL is a postgres:// URL used instead of the DB* connection
+	// settings when set.
+	DatabaseURL      string
+	DBHost           string
+	DBPort           int
 	DBName           string
 	DBUser           string
-	DBConnectTimeout int
-	LogLevel         int
-	Port             int
+	DBPassword       string
+	DBSSLMode        string
+	DBConnectTimeout time.Duration
+	// DBMaxOpenConns and DBMaxIdleConns size the connection pool. Zero
+	// keeps the database/sql defaults.
+	DBMaxOpenConns int
+	DBMaxIdleConns int
+	// DBConnMaxLifetime is how long a connection may be reused. Zero
+	// means forever.
+	DBConnMaxLifetime time.Duration
+	DBMigrateOnStart  bool
+	// LogLevel is the least severe level logged: debug, info, warn or
+	// error.
+	LogLevel string
+	// PubSubDriver selects the pubsub: memory delivers events within the
+	// process, postgres delivers them to every server sharing the
+	// database.
+	PubSubDriver string
+	// PubSubChannel is the notification channel of the postgres pubsub.
+	PubSubChannel string
+	// PubSubBufferSize is how many events are queued per subscriber.
+	PubSubBufferSize int
+	// PubSubDeliveryTimeout is how long publishing waits for a slow
+	// subscriber before dropping the event for it.
+	PubSubDeliveryTimeout time.Duration
+	// OutboxPollInterval is how often the outbox is checked for events
+	// written by other servers.
+	OutboxPollInterval time.Duration
+	// OutboxMaxAttempts is how many times an outbox event is published
+	// before it is set aside as failed.
+	OutboxMaxAttempts int
+	// OutboxRetention is how long delivered and failed outbox events are
+	// kept.
+	OutboxRetention time.Duration
+	// EventReplayLimit is how many missed events a resuming subscription
+	// may replay.
+	EventReplayLimit int
+	// ShutdownTimeout is how long the server waits for in-flight
+	// requests and subscriptions when shutting down.
+	ShutdownTimeout time.Duration
+
+	// DotEnvLoaded reports whether variables were read from a .env file.
+	// It is not a setting.
+	DotEnvLoaded bool
 }
 
-// New creates an instance of config.
-func New() Config {
-	err := godotenv.Load()
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Println(".env not found. Loading env variables from process env")
-		} else {
-			log.Fatal(err)
+// setting describes a configuration value. Its name is the key in the
+// config file; the environment variable is the upper-cased name and the
+// flag replaces underscores with dashes.
+type setting struct {
+	name   string
+	usage  string
+	secret bool
+	value  func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{name: "app_env", usage: "application environment", value: func(c *Config) interface{} { return &c.AppEnv }},
+	{name: "host", usage: "interface the server listens on", value: func(c *Config) interface{} { return &c.Host }},
+	{name: "port", usage: "port the server listens on", value: func(c *Config) interface{} { return &c.Port }},
+	{name: "database_url", usage: "postgres:// URL, overrides the db_* connection settings", secret: true, value: func(c *Config) interface{} { return &c.DatabaseURL }},
+	{name: "db_host", usage: "database host", value: func(c *Config) interface{} { return &c.DBHost }},
+	{name: "db_port", usage: "database port", value: func(c *Config) interface{} { return &c.DBPort }},
+	{name: "db_name", usage: "database name", value: func(c *Config) interface{} { return &c.DBName }},
+	{name: "db_user", usage: "database user", value: func(c *Config) interface{} { return &c.DBUser }},
+	{name: "db_password", usage: "database password", secret: true, value: func(c *Config) interface{} { return &c.DBPassword }},
+	{name: "db_sslmode", usage: "database sslmode", value: func(c *Config) interface{} { return &c.DBSSLMode }},
+	{name: "db_connect_timeout", usage: "how long to wait for a database connection, in whole seconds, 0 waits indefinitely", value: func(c *Config) interface{} { return &c.DBConnectTimeout }},
+	{name: "db_max_open_conns", usage: "maximum open database connections, 0 is unlimited", value: func(c *Config) interface{} { return &c.DBMaxOpenConns }},
+	{name: "db_max_idle_conns", usage: "maximum idle database connections, 0 keeps the default", value: func(c *Config) interface{} { return &c.DBMaxIdleConns }},
+	{name: "db_conn_max_lifetime", usage: "how long a database connection may be reused, 0 is forever", value: func(c *Config) interface{} { return &c.DBConnMaxLifetime }},
+	{name: "db_migrate_on_start", usage: "apply pending migrations when the server starts", value: func(c *Config) interface{} { return &c.DBMigrateOnStart }},
+	{name: "log_level", usage: "least severe level logged: debug, info, warn or error, or 0 to 3", value: func(c *Config) interface{} { return &c.LogLevel }},
+	{name: "pubsub_driver", usage: "pubsub delivering events: memory or postgres", value: func(c *Config) interface{} { return &c.PubSubDriver }},
+	{name: "pubsub_channel", usage: "notification channel of the postgres pubsub", value: func(c *Config) interface{} { return &c.PubSubChannel }},
+	{name: "pubsub_buffer_size", usage: "events queued per subscriber", value: func(c *Config) interface{} { return &c.PubSubBufferSize }},
+	{name: "pubsub_delivery_timeout", usage: "how long to wait for a slow subscriber before dropping an event, 0 drops right away", value: func(c *Config) interface{} { return &c.PubSubDeliveryTimeout }},
+	{name: "outbox_poll_interval", usage: "how often the outbox is checked for events written by other servers", value: func(c *Config) interface{} { return &c.OutboxPollInterval }},
+	{name: "outbox_max_attempts", usage: "how many times an outbox event is published before it is set aside as failed", value: func(c *Config) interface{} { return &c.OutboxMaxAttempts }},
+	{name: "outbox_retention", usage: "how long delivered and failed outbox events are kept", value: func(c *Config) interface{} { return &c.OutboxRetention }},
+	{name: "event_replay_limit", usage: "how many missed events a resuming subscription may replay", value: func(c *Config) interface{} { return &c.EventReplayLimit }},
+	{name: "shutdown_timeout", usage: "how long to drain requests and subscriptions on shutdown", value: func(c *Config) interface{} { return &c.ShutdownTimeout }},
+}
+
+// ValidationError reports every invalid or missing configuration value.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Defaults returns the configuration used when nothing is set.
+func Defaults() Config {
+	return Config{
+		AppEnv:             "development",
+		Port:               10000,
+		DBHost:             "localhost",
+		DBPort:             5432,
+		DBSSLMode:          "disable",
+		LogLevel:           "info",
+		PubSubDriver:       "memory",
+		PubSubChannel:      "graphql_events",
+		PubSubBufferSize:   64,
+		OutboxPollInterval: time.Second,
+		OutboxMaxAttempts:  10,
+		OutboxRetention:    24 * time.Hour,
+		EventReplayLimit:   1000,
+		ShutdownTimeout:    15 * time.Second,
+	}
+}
+
+// Load registers the configuration flags on fs, parses args and returns
+// the configuration layered from the defaults, the config file, the
+// environment and the flags. The config file is named by the -config flag
+// or the CONFIG_FILE environment variable. Variables in a .env file are
+// added to the environment first. Every problem found is reported in a
+// single *ValidationError.
+func Load(fs *flag.FlagSet, args []string) (Config, error) {
+	dotEnvErr := godotenv.Load()
+	if dotEnvErr != nil && !errors.Is(dotEnvErr, os.ErrNotExist) {
+		return Config{}, dotEnvErr
+	}
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path of a YAML config file")
+	for _, s := range settings {
+		_, isBool := s.value(&Config{}).(*bool)
+		fs.Var(&flagValue{isBool: isBool}, flagName(s.name), s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := Defaults()
+	cfg.DotEnvLoaded = dotEnvErr == nil
+	var problems []string
+	set := func(source string, s setting, raw string) {
+		if err := setValue(s.value(&cfg), raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", source, err))
 		}
 	}
 
-	return Config{
-		AppEnv:           getEnv("APP_ENV", "development"),
-		DBName:           getEnv("DB_NAME", ""),
-		DBUser:           getEnv("DB_USER", ""),
-		DBConnectTimeout: getEnvAsInt("DB_CONNECT_TIMEOUT", 0),
-		Port:             getEnvAsInt("PORT", 10000),
-		LogLevel:         getEnvAsInt("LOG_LEVEL", 0),
+	if *configFile != "" {
+		values, err := readFile(*configFile)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, s := range settings {
+			if raw, ok := values[s.name]; ok {
+				set(fmt.Sprintf("%s: %s", *configFile, s.name), s, raw)
+				delete(values, s.name)
+			}
+		}
+		for name := range values {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %q", *configFile, name))
+		}
+	}
+
+	for _, s := range settings {
+		env := strings.ToUpper(s.name)
+		if raw, ok := os.LookupEnv(env); ok {
+			set("env "+env, s, raw)
+		}
 	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if flagName(s.name) == f.Name {
+				set("flag -"+f.Name, s, f.Value.String())
+			}
+		}
+	})
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
 }
 
-// Simple helper function to read an environment or return a default value.
-func getEnv(key, defaultValue string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+// ListenAddr returns the address the server listens on.
+func (c Config) ListenAddr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// String returns the effective configuration, one setting per line, with
+// secrets redacted.
+func (c Config) String() string {
+	var b strings.Builder
+	for _, s := range settings {
+		value := fmt.Sprint(deref(s.value(&c)))
+		if s.secret {
+			value = redact(s.name, value)
+		}
+		fmt.Fprintf(&b, "%s = %s\n", s.name, value)
+	}
+	return b.String()
+}
+
+// validate returns the problems of a loaded configuration.
+func (c Config) validate() []string {
+	var problems []string
+	if c.Port < 1 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port: %d is not a valid port", c.Port))
+	}
+	if c.DatabaseURL != "" {
+		if _, err := url.Parse(c.DatabaseURL); err != nil {
+			problems = append(problems, "database_url: invalid URL")
+		}
+	} else {
+		if c.DBName == "" {
+			problems = append(problems, "db_name: required unless database_url is set")
+		}
+		if c.DBUser == "" {
+			problems = append(problems, "db_user: required unless database_url is set")
+		}
+		if c.DBPort < 1 || c.DBPort > 65535 {
+			problems = append(problems, fmt.Sprintf("db_port: %d is not a valid port", c.DBPort))
+		}
+		switch c.DBSSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			problems = append(problems, fmt.Sprintf("db_sslmode: unsupported mode %q", c.DBSSLMode))
+		}
+	}
+	if c.DBConnectTimeout < 0 {
+		problems = append(problems, "db_connect_timeout: must not be negative")
+	} else if c.DBConnectTimeout%time.Second != 0 {
+		// the connection string only takes whole seconds, and 0 waits
+		// indefinitely
+		problems = append(problems, fmt.Sprintf("db_connect_timeout: %v is not a whole number of seconds", c.DBConnectTimeout))
+	}
+	if c.DBMaxOpenConns < 0 {
+		problems = append(problems, "db_max_open_conns: must not be negative")
+	}
+	if c.DBMaxIdleConns < 0 {
+		problems = append(problems, "db_max_idle_conns: must not be negative")
+	}
+	if c.DBConnMaxLifetime < 0 {
+		problems = append(problems, "db_conn_max_lifetime: must not be negative")
+	}
+	switch c.PubSubDriver {
+	case "memory":
+	case "postgres":
+		if c.PubSubChannel == "" {
+			problems = append(problems, "pubsub_channel: required by the postgres pubsub")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("pubsub_driver: unsupported driver %q", c.PubSubDriver))
+	}
+	if c.PubSubBufferSize < 1 {
+		problems = append(problems, "pubsub_buffer_size: must be positive")
+	}
+	if c.PubSubDeliveryTimeout < 0 {
+		problems = append(problems, "pubsub_delivery_timeout: must not be negative")
+	}
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, "log_level: "+err.Error())
 	}
-	return defaultValue
+	if c.OutboxPollInterval <= 0 {
+		problems = append(problems, "outbox_poll_interval: must be positive")
+	}
+	if c.OutboxMaxAttempts < 1 {
+		problems = append(problems, "outbox_max_attempts: must be positive")
+	}
+	if c.OutboxRetention <= 0 {
+		problems = append(problems, "outbox_retention: must be positive")
+	}
+	if c.EventReplayLimit < 1 {
+		problems = append(problems, "event_replay_limit: must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout: must be positive")
+	}
+	return problems
 }
 
-// Helper to read an environment variable into a bool or return a default value.
-func getEnvAsBool(name string, defaultVal bool) bool {
-	valStr := getEnv(name, "")
-	if val, err := strconv.ParseBool(valStr); err == nil {
-		return val
+// readFile reads the settings of a YAML config file as strings.
+func readFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if value == nil {
+			value = ""
+		}
+		values[name] = fmt.Sprint(value)
 	}
-	return defaultVal
+	return values, nil
 }
 
-// Simple helper function to read an environment variable into an integer
-// or return a default value.
-func getEnvAsInt(name string, defaultVal int) int {
-	valueStr := getEnv(name, "")
-	if value, err := strconv.Atoi(valueStr); err == nil {
+// setValue parses raw into the value pointed to by ptr. Durations accept
+// a unit, e.g. 1m30s; a bare number is a number of seconds.
+func setValue(ptr interface{}, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch v := ptr.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		*v = n
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		*v = b
+	case *time.Duration:
+		if n, err := strconv.Atoi(raw); err == nil {
+			*v = time.Duration(n) * time.Second
+			return nil
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		*v = d
+	default:
+		return fmt.Errorf("unsupported type %T", ptr)
+	}
+	return nil
+}
+
+// deref returns the value a setting points to.
+func deref(ptr interface{}) interface{} {
+	switch v := ptr.(type) {
+	case *string:
+		return *v
+	case *int:
+		return *v
+	case *bool:
+		return *v
+	case *time.Duration:
+		return *v
+	}
+	return ptr
+}
+
+// redact hides a secret value. URLs keep everything but their password.
+func redact(name, value string) string {
+	if value == "" {
 		return value
 	}
-	return defaultVal
+	if name == "database_url" {
+		u, err := url.Parse(value)
+		if err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "redacted")
+			}
+			return u.String()
+		}
+	}
+	return "redacted"
+}
+
+// flagValue holds the raw value of a setting flag until it is layered
+// over the other sources. Flags of bool settings may be given without a
+// value, e.g. -db-migrate-on-start.
+type flagValue struct {
+	raw    string
+	isBool bool
+}
+
+func (f *flagValue) String() string { return f.raw }
+
+func (f *flagValue) Set(raw string) error {
+	f.raw = raw
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+
+func flagName(name string) string {
+	return strings.Replace(name, "_", "-", -1)
 }
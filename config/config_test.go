@@ -0,0 +1,198 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setEnv unsets the environment variable of every setting, sets the
+// variables of env and returns a function restoring the environment.
+func setEnv(env map[string]string) func() {
+	saved := make(map[string]string)
+	keys := make([]string, 0, len(settings)+1)
+	for _, name := range append([]string{"config_file"}, settingNames()...) {
+		key := strings.ToUpper(name)
+		keys = append(keys, key)
+		if v, ok := os.LookupEnv(key); ok {
+			saved[key] = v
+		}
+		os.Unsetenv(key)
+	}
+	for key, v := range env {
+		os.Setenv(key, v)
+	}
+
+	return func() {
+		for _, key := range keys {
+			os.Unsetenv(key)
+		}
+		for key, v := range saved {
+			os.Setenv(key, v)
+		}
+	}
+}
+
+func settingNames() []string {
+	names := make([]string, len(settings))
+	for i, s := range settings {
+		names[i] = s.name
+	}
+	return names
+}
+
+// writeConfigFile writes a config file and returns its path and a
+// function removing it.
+func writeConfigFile(t *testing.T, content string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func load(t *testing.T, args ...string) (Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return Load(fs, args)
+}
+
+func TestLoadLayering(t *testing.T) {
+	defer setEnv(map[string]string{"PORT": "9000", "DB_USER": "env_user"})()
+	path, remove := writeConfigFile(t, `
+db_name: file_db
+db_user: file_user
+port: 8000
+log_level: debug
+shutdown_timeout: 5
+`)
+	defer remove()
+
+	cfg, err := load(t, "-config", path, "-db-user", "flag_user", "-db-migrate-on-start")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"default", cfg.DBHost, "localhost"},
+		{"file", cfg.DBName, "file_db"},
+		{"file duration in seconds", cfg.ShutdownTimeout, 5 * time.Second},
+		{"env over file", cfg.Port, 9000},
+		{"flag over env", cfg.DBUser, "flag_user"},
+		{"bool flag without a value", cfg.DBMigrateOnStart, true},
+		{"unset keeps file", cfg.LogLevel, "debug"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadBoolFlagValue(t *testing.T) {
+	defer setEnv(map[string]string{"DB_MIGRATE_ON_START": "true"})()
+
+	cfg, err := load(t, "-db-name", "db", "-db-user", "user", "-db-migrate-on-start=false")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.DBMigrateOnStart {
+		t.Error("DBMigrateOnStart = true, want the flag's false")
+	}
+}
+
+func TestLoadNumericLogLevel(t *testing.T) {
+	defer setEnv(map[string]string{"LOG_LEVEL": "0"})()
+
+	cfg, err := load(t, "-db-name", "db", "-db-user", "user")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.LogLevel != "0" {
+		t.Errorf("LogLevel = %q, want 0", cfg.LogLevel)
+	}
+}
+
+func TestLoadCollectsProblems(t *testing.T) {
+	defer setEnv(map[string]string{"DB_PORT": "five", "DB_CONNECT_TIMEOUT": "500ms"})()
+	path, remove := writeConfigFile(t, `
+port: 0
+colour: blue
+`)
+	defer remove()
+
+	_, err := load(t, "-config", path, "-pubsub-driver", "kafka", "-log-level", "loud")
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Load() error = %v, want a *ValidationError", err)
+	}
+
+	want := []string{
+		`unknown setting "colour"`,
+		`env DB_PORT: invalid integer "five"`,
+		"port: 0 is not a valid port",
+		"db_name: required",
+		"db_user: required",
+		`pubsub_driver: unsupported driver "kafka"`,
+		"log_level:",
+		"db_connect_timeout: 500ms is not a whole number of seconds",
+	}
+	for _, w := range want {
+		found := false
+		for _, p := range verr.Problems {
+			if strings.Contains(p, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("problems %q do not report %q", verr.Problems, w)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"db_password", "", ""},
+		{"db_password", "hunter2", "redacted"},
+		{"database_url", "postgres://kevin:hunter2@db:5432/app", "postgres://kevin:redacted@db:5432/app"},
+		{"database_url", "postgres://kevin@db/app", "postgres://kevin@db/app"},
+		{"database_url", "postgres://db/app", "redacted"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.name, tt.value); got != tt.want {
+			t.Errorf("redact(%s, %q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestConfigStringRedactsSecrets(t *testing.T) {
+	cfg := Defaults()
+	cfg.DBPassword = "hunter2"
+	cfg.DatabaseURL = "postgres://kevin:hunter2@db/app"
+
+	s := cfg.String()
+	if strings.Contains(s, "hunter2") {
+		t.Errorf("String() leaks a secret:\n%s", s)
+	}
+	if !strings.Contains(s, "db_password = redacted\n") {
+		t.Errorf("String() does not redact db_password:\n%s", s)
+	}
+}
@@ -9,3 +9,104 @@ type User struct {
 	Profession string
 	Friendly   bool
 }
+
+// UserChange is the state of a user before and after an update.
+type UserChange struct {
+	Before User
+	After  User
+}
+
+// ChangedFields returns the names of the fields that differ between
+// Before and After.
+func (c UserChange) ChangedFields() []string {
+	fields := make([]string, 0)
+	if c.Before.Name != c.After.Name {
+		fields = append(fields, "name")
+	}
+	if c.Before.Email != c.After.Email {
+		fields = append(fields, "email")
+	}
+	if c.Before.Age != c.After.Age {
+		fields = append(fields, "age")
+	}
+	if c.Before.Profession != c.After.Profession {
+		fields = append(fields, "profession")
+	}
+	if c.Before.Friendly != c.After.Friendly {
+		fields = append(fields, "friendly")
+	}
+	return fields
+}
+
+// Event is published to the subscribers of Topic once the change that
+// caused it is committed.
+type Event struct {
+	Topic   string
+	Payload interface{}
+}
+
+// UserOrder is the order in which a list of users is sorted.
+type UserOrder string
+
+// Supported user orderings. Ties are always broken by ID.
+const (
+	UserOrderIDAsc     UserOrder = "ID_ASC"
+	UserOrderIDDesc    UserOrder = "ID_DESC"
+	UserOrderNameAsc   UserOrder = "NAME_ASC"
+	UserOrderNameDesc  UserOrder = "NAME_DESC"
+	UserOrderAgeAsc    UserOrder = "AGE_ASC"
+	UserOrderAgeDesc   UserOrder = "AGE_DESC"
+	UserOrderEmailAsc  UserOrder = "EMAIL_ASC"
+	UserOrderEmailDesc UserOrder = "EMAIL_DESC"
+)
+
+// UserFilter narrows down a list of users. A user matches when it
+// satisfies every set field, every filter in And and, when Or is not
+// empty, at least one filter in Or. Zero valued fields do not filter.
+type UserFilter struct {
+	// NameContains matches users whose name contains the given text,
+	// ignoring case.
+	NameContains string
+	// NameStartsWith matches users whose name starts with the given text,
+	// ignoring case.
+	NameStartsWith string
+	Email          string
+	// AgeMin and AgeMax bound the age of users, inclusively.
+	AgeMin       *int
+	AgeMax       *int
+	ProfessionIn []string
+	Friendly     *bool
+	And          []UserFilter
+	Or           []UserFilter
+}
+
+// UserPageArgs describes the page of users to fetch.
+// First/After page forwards and Last/Before page backwards.
+type UserPageArgs struct {
+	Filter  UserFilter
+	OrderBy UserOrder
+	First   *int
+	After   string
+	Last    *int
+	Before  string
+}
+
+// UserEdge is a user in a page together with its cursor.
+type UserEdge struct {
+	Cursor string
+	Node   User
+}
+
+// PageInfo describes the position of a page within the full list.
+type PageInfo struct {
+	HasNextPage     bool
+	HasPreviousPage bool
+	StartCursor     string
+	EndCursor       string
+}
+
+// UserPage is a page of users.
+type UserPage struct {
+	Edges    []UserEdge
+	PageInfo PageInfo
+}
@@ -0,0 +1,99 @@
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrEventsUnavailable is returned when the events asked for are no longer
+// all in the outbox.
+var ErrEventsUnavailable = errors.New("events are no longer available")
+
+// RelayedEvent is an event relayed from the outbox, identified by its
+// delivery sequence.
+type RelayedEvent struct {
+	Seq     int64
+	Payload interface{}
+}
+
+// EventLog reads the events relayed from the outbox, which keeps them for
+// the outbox retention period.
+type EventLog struct {
+	db     *Postgres
+	decode DecodeFunc
+	limit  int
+}
+
+// NewEventLog creates an EventLog decoding the payloads with decode and
+// replaying at most limit events to a subscription.
+func NewEventLog(db *Postgres, decode DecodeFunc, limit int) *EventLog {
+	return &EventLog{db: db, decode: decode, limit: limit}
+}
+
+// EventsAfter returns the events published on the topic after the event
+// with the given delivery sequence, oldest first, including the ones the
+// relay is still publishing. It fails with ErrEventsUnavailable when some
+// of them were purged or there are more than the limit.
+func (l *EventLog) EventsAfter(ctx context.Context, topic string, seq int64) ([]RelayedEvent, error) {
+	var purged int64
+	err := l.db.QueryRowContext(ctx, `SELECT seq FROM outbox_purged;`).Scan(&purged)
+	if err != nil {
+		return nil, errors.Wrap(err, "EventsAfter failed")
+	}
+	if seq < purged {
+		return nil, ErrEventsUnavailable
+	}
+
+	query := `
+	SELECT
+		seq, topic, payload_type, payload
+	FROM
+		outbox
+	WHERE
+		seq > $1 AND failed_at IS NULL AND topic ~ $2
+	ORDER BY seq
+	LIMIT $3;`
+	rows, err := l.db.QueryContext(ctx, query, seq, topicRegexp(topic), l.limit+1)
+	if err != nil {
+		return nil, errors.Wrap(err, "EventsAfter failed")
+	}
+	defer rows.Close()
+
+	events := make([]RelayedEvent, 0)
+	for rows.Next() {
+		var e outboxEvent
+		if err := rows.Scan(&e.seq, &e.topic, &e.payloadType, &e.payload); err != nil {
+			return nil, errors.Wrap(err, "EventsAfter failed")
+		}
+		payload, err := l.decode(e.payloadType, e.payload)
+		if err != nil {
+			return nil, errors.Wrapf(err, "EventsAfter failed to decode event %d", e.seq)
+		}
+		events = append(events, RelayedEvent{Seq: e.seq, Payload: payload})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "EventsAfter failed")
+	}
+	if len(events) > l.limit {
+		return nil, ErrEventsUnavailable
+	}
+	return events, nil
+}
+
+// topicRegexp returns the regular expression matching the topics a
+// subscription topic receives. Topic levels are separated by dots and *
+// matches any single level, as in the pubsub package.
+func topicRegexp(topic string) string {
+	levels := strings.Split(topic, ".")
+	for i, level := range levels {
+		if level == "*" {
+			levels[i] = `[^.]+`
+			continue
+		}
+		levels[i] = regexp.QuoteMeta(level)
+	}
+	return "^" + strings.Join(levels, `\.`) + "$"
+}
@@ -0,0 +1,93 @@
+package postgres
+
+// Migrations is the ordered list of schema migrations for the API.
+// New migrations must be appended with a higher version.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_users",
+		Up: `
+		CREATE TABLE IF NOT EXISTS users (
+			id serial PRIMARY KEY,
+			name VARCHAR (50) NOT NULL,
+			email VARCHAR (255) NOT NULL,
+			age INT NOT NULL,
+			profession VARCHAR (50) NOT NULL,
+			friendly BOOLEAN NOT NULL,
+			CONSTRAINT "email must be unique" UNIQUE(email)
+		);`,
+		Down: `DROP TABLE IF EXISTS users;`,
+	},
+	{
+		Version: 2,
+		Name:    "create_pubsub_payloads",
+		Up: `
+		CREATE TABLE IF NOT EXISTS pubsub_payloads (
+			id bigserial PRIMARY KEY,
+			message TEXT NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS pubsub_payloads_created_at ON pubsub_payloads (created_at);`,
+		Down: `DROP TABLE IF EXISTS pubsub_payloads;`,
+	},
+	{
+		Version: 3,
+		Name:    "create_outbox",
+		Up: `
+		CREATE TABLE IF NOT EXISTS outbox (
+			id bigserial PRIMARY KEY,
+			topic TEXT NOT NULL,
+			payload_type TEXT NOT NULL,
+			payload JSONB NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			attempts INT NOT NULL DEFAULT 0,
+			last_error TEXT,
+			delivered_at TIMESTAMPTZ
+		);
+		CREATE INDEX IF NOT EXISTS outbox_undelivered ON outbox (id) WHERE delivered_at IS NULL;`,
+		Down: `DROP TABLE IF EXISTS outbox;`,
+	},
+	{
+		Version: 4,
+		Name:    "add_outbox_failed_at",
+		Up: `
+		ALTER TABLE outbox ADD COLUMN IF NOT EXISTS failed_at TIMESTAMPTZ;
+		DROP INDEX IF EXISTS outbox_undelivered;
+		CREATE INDEX outbox_undelivered ON outbox (id) WHERE delivered_at IS NULL AND failed_at IS NULL;`,
+		Down: `
+		DROP INDEX IF EXISTS outbox_undelivered;
+		CREATE INDEX outbox_undelivered ON outbox (id) WHERE delivered_at IS NULL;
+		ALTER TABLE outbox DROP COLUMN IF EXISTS failed_at;`,
+	},
+	{
+		Version: 5,
+		Name:    "add_outbox_seq",
+		Up: `
+		CREATE SEQUENCE IF NOT EXISTS outbox_seq;
+		ALTER TABLE outbox ADD COLUMN IF NOT EXISTS seq BIGINT;
+		UPDATE outbox SET seq = id WHERE delivered_at IS NOT NULL;
+		SELECT setval('outbox_seq', GREATEST(
+			(SELECT COALESCE(MAX(id), 0) FROM outbox),
+			(SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM outbox_id_seq)) + 1, false);
+		CREATE UNIQUE INDEX IF NOT EXISTS outbox_seq_key ON outbox (seq);
+		CREATE TABLE IF NOT EXISTS outbox_purged (
+			seq BIGINT NOT NULL
+		);
+		INSERT INTO outbox_purged (seq) SELECT COALESCE(
+			(SELECT MIN(seq) - 1 FROM outbox),
+			(SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM outbox_id_seq));`,
+		Down: `
+		DROP TABLE IF EXISTS outbox_purged;
+		DROP INDEX IF EXISTS outbox_seq_key;
+		ALTER TABLE outbox DROP COLUMN IF EXISTS seq;
+		DROP SEQUENCE IF EXISTS outbox_seq;`,
+	},
+	{
+		Version: 6,
+		Name:    "add_outbox_claimed_at",
+		Up: `
+		ALTER TABLE outbox ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ;`,
+		Down: `
+		ALTER TABLE outbox DROP COLUMN IF EXISTS claimed_at;`,
+	},
+}
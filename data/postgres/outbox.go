@@ -0,0 +1,585 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dikaeinstein/go-graphql-api/data"
+	"github.com/dikaeinstein/go-graphql-api/logger"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// outboxLockID is the key of the advisory lock held by the relay reading
+// the outbox, so that the relays of concurrently running instances don't
+// publish the same events.
+const outboxLockID = 7238042
+
+// outboxClaimLease is how long the events claimed by a relay are left to
+// it while it publishes them. Once it expires, e.g. because the instance
+// was killed, another relay publishes them again.
+const outboxClaimLease = time.Minute
+
+// commitWithEvents writes events to the outbox in tx and commits it. The
+// relay is woken up once the events are committed.
+func (p *Postgres) commitWithEvents(ctx context.Context, tx *sql.Tx, events []data.Event) error {
+	for _, e := range events {
+		payload, err := json.Marshal(e.Payload)
+		if err != nil {
+			return fmt.Errorf("encode payload of %s: %v", e.Topic, err)
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO outbox (topic, payload_type, payload) VALUES ($1, $2, $3);`,
+			e.Topic, fmt.Sprintf("%T", e.Payload), string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		select {
+		case p.outboxWritten <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// PublishFunc publishes an event relayed from the outbox. id is the
+// delivery sequence of the event: the relay holding the outbox lock
+// assigns it in the order the events are relayed, so it only ever grows,
+// whatever the order the events were committed in.
+type PublishFunc func(ctx context.Context, id int64, topic string, payload interface{}) error
+
+// DecodeFunc decodes the JSON payload of an event relayed from the
+// outbox. typeName is the Go type of the written payload, e.g.
+// *data.User.
+type DecodeFunc func(typeName string, raw []byte) (interface{}, error)
+
+// RelayConfig configures an OutboxRelay. Zero durations and sizes keep
+// the defaults.
+type RelayConfig struct {
+	// Publish publishes the events. Required.
+	Publish PublishFunc
+	// Decode decodes the payloads. By default they are decoded into
+	// generic JSON values.
+	Decode DecodeFunc
+	// BatchSize is how many events are read at once. Defaults to 100.
+	BatchSize int
+	// PollInterval is how often the outbox is read when no event is
+	// written by this instance. Defaults to 1s.
+	PollInterval time.Duration
+	// MinBackoff and MaxBackoff bound the wait before retrying a failed
+	// publish, which doubles while publishing keeps failing. They default
+	// to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is how many times an event is published before it is
+	// set aside as failed, so that it stops holding back the events after
+	// it. Defaults to 10. Events whose payload can't be decoded fail
+	// right away.
+	MaxAttempts int
+	// Retention is how long delivered and failed events are kept.
+	// Defaults to 24h.
+	Retention time.Duration
+	// Local makes every instance publish every event, for a pubsub that
+	// only delivers within the instance. The relay holding the outbox
+	// lock marks the events delivered without publishing them, and each
+	// relay publishes the delivered events it has not published yet,
+	// starting from the ones delivered after it started. Events written
+	// by another instance are published within a PollInterval.
+	Local bool
+}
+
+// OutboxRelay publishes the events written to the outbox, in the order
+// they were written, and marks them delivered. An event that fails to
+// publish is retried with backoff and holds back the events after it
+// until it fails MaxAttempts times.
+type OutboxRelay struct {
+	db  *Postgres
+	cfg RelayConfig
+	log *logger.Logger
+
+	// published is the sequence of the last event published by a Local
+	// relay.
+	published int64
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewOutboxRelay creates a relay reading the outbox of db. Call Start to
+// run it.
+func NewOutboxRelay(db *Postgres, cfg RelayConfig) *OutboxRelay {
+	if cfg.Decode == nil {
+		cfg.Decode = func(_ string, raw []byte) (interface{}, error) {
+			var v interface{}
+			err := json.Unmarshal(raw, &v)
+			return v, err
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = 24 * time.Hour
+	}
+	return &OutboxRelay{db: db, cfg: cfg, log: db.log, done: make(chan struct{})}
+}
+
+// Start runs the relay in a goroutine until Close is called.
+func (r *OutboxRelay) Start() {
+	r.wg.Add(1)
+	go r.run()
+}
+
+// Close stops the relay and waits for the batch being relayed.
+func (r *OutboxRelay) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+	})
+	return nil
+}
+
+func (r *OutboxRelay) run() {
+	defer r.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.done
+		cancel()
+	}()
+
+	if r.cfg.Local {
+		for {
+			err := r.db.QueryRowContext(ctx,
+				`SELECT COALESCE(MAX(seq), 0) FROM outbox;`).Scan(&r.published)
+			if err == nil {
+				break
+			}
+			r.log.Warn("failed to read the outbox position", "error", err)
+			select {
+			case <-r.done:
+				return
+			case <-time.After(r.cfg.PollInterval):
+			}
+		}
+	}
+
+	backoff := time.Duration(0)
+	lastPurge := time.Time{}
+	for {
+		wait := r.cfg.PollInterval
+		more, err := r.relayBatch(ctx)
+		if err == nil && r.cfg.Local {
+			err = r.publishDelivered(ctx)
+		}
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return
+			}
+			backoff = nextBackoff(backoff, r.cfg.MinBackoff, r.cfg.MaxBackoff)
+			r.log.Warn("failed to relay outbox events", "error", err, "retry_in", backoff)
+			wait = backoff
+		case more:
+			backoff = 0
+			continue
+		default:
+			backoff = 0
+		}
+
+		if time.Since(lastPurge) > r.cfg.Retention/24 {
+			r.purge(ctx)
+			lastPurge = time.Now()
+		}
+
+		// keep backing off on failures, a new event doesn't fix the
+		// publisher
+		written := r.db.outboxWritten
+		if err != nil {
+			written = nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.done:
+			timer.Stop()
+			return
+		case <-written:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// outboxEvent is an event read from the outbox.
+type outboxEvent struct {
+	id          int64
+	topic       string
+	payloadType string
+	payload     []byte
+	attempts    int
+	seq         int64
+}
+
+// decodeError is a payload that can't be decoded. Publishing it again
+// won't help.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("decode payload: %v", e.err)
+}
+
+// relayBatch relays the next batch of undelivered events and reports
+// whether the batch was full, i.e. more events may be waiting. The batch
+// is claimed and given its delivery sequences first, so that the EventLog
+// sees the events before they are published, and no transaction is held
+// open while publishing. The events are then published in order and the
+// published ones marked delivered. A Local relay marks the batch delivered
+// when claiming it.
+func (r *OutboxRelay) relayBatch(ctx context.Context) (bool, error) {
+	events, err := r.claim(ctx)
+	if err != nil || r.cfg.Local || len(events) == 0 {
+		return err == nil && len(events) == r.cfg.BatchSize, err
+	}
+
+	publishCtx, cancel := context.WithTimeout(ctx, outboxClaimLease/2)
+	defer cancel()
+	delivered := make([]int64, 0, len(events))
+	var failures []publishFailure
+	var publishErr error
+	for _, e := range events {
+		err := r.publish(publishCtx, e)
+		if err == nil {
+			delivered = append(delivered, e.id)
+			continue
+		}
+		if ctx.Err() != nil {
+			publishErr = ctx.Err()
+			break
+		}
+		failures = append(failures, publishFailure{event: e, err: err})
+		if r.retries(e, err) {
+			publishErr = errors.Wrapf(err, "publish outbox event %d", e.id)
+			break
+		}
+	}
+
+	if err := r.settle(events, delivered, failures); err != nil {
+		return false, err
+	}
+	return publishErr == nil && len(events) == r.cfg.BatchSize, publishErr
+}
+
+// claim claims the next batch of undelivered events, in order, and draws
+// the delivery sequences of the events without one. A Local relay marks
+// them delivered instead. Nothing is claimed while the relay of another
+// instance holds the outbox lock or an unexpired claim.
+func (r *OutboxRelay) claim(ctx context.Context) ([]outboxEvent, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1);`, outboxLockID).Scan(&locked)
+	if err != nil || !locked {
+		return nil, err
+	}
+	var claimed bool
+	query := `
+	SELECT EXISTS (
+		SELECT 1 FROM outbox
+		WHERE delivered_at IS NULL AND failed_at IS NULL
+			AND claimed_at > now() - $1 * interval '1 second'
+	);`
+	err = tx.QueryRowContext(ctx, query, int(outboxClaimLease/time.Second)).Scan(&claimed)
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	events, err := r.undelivered(ctx, tx)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	if err := assignSeqs(ctx, tx, events); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(events))
+	seqs := make([]int64, len(events))
+	for i, e := range events {
+		ids[i], seqs[i] = e.id, e.seq
+	}
+	mark := "claimed_at"
+	if r.cfg.Local {
+		mark = "delivered_at"
+	}
+	query = fmt.Sprintf(`
+	UPDATE outbox o SET
+		%s = now(), seq = d.seq
+	FROM
+		unnest($1::bigint[], $2::bigint[]) AS d(id, seq)
+	WHERE
+		o.id = d.id;`, mark)
+	if _, err := tx.ExecContext(ctx, query, pq.Array(ids), pq.Array(seqs)); err != nil {
+		return nil, err
+	}
+	return events, tx.Commit()
+}
+
+// publishFailure is an event of a claimed batch that failed to publish.
+type publishFailure struct {
+	event outboxEvent
+	err   error
+}
+
+// settle marks the delivered events of a claimed batch, records the
+// failures and releases the claim on the rest, which keep their delivery
+// sequences. It runs even when the relay is being closed, so that the
+// events already published are not published again once the claim would
+// have expired.
+func (r *OutboxRelay) settle(events []outboxEvent, delivered []int64, failures []publishFailure) error {
+	ctx, cancel := context.WithTimeout(context.Background(), outboxClaimLease/2)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(delivered) > 0 {
+		_, err := tx.ExecContext(ctx,
+			`UPDATE outbox SET delivered_at = now() WHERE id = ANY($1);`, pq.Array(delivered))
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range failures {
+		if err := r.recordFailure(ctx, tx, f.event, f.err); err != nil {
+			return err
+		}
+	}
+
+	ids := make([]int64, len(events))
+	for i, e := range events {
+		ids[i] = e.id
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE outbox SET claimed_at = NULL WHERE id = ANY($1);`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// assignSeqs draws the delivery sequences of the events without one, in
+// order. Events claimed before keep theirs, which are lower, as the
+// EventLog may already have returned them. The sequences of the events
+// that end up failing are skipped.
+func assignSeqs(ctx context.Context, tx *sql.Tx, events []outboxEvent) error {
+	unassigned := make([]int, 0, len(events))
+	for i, e := range events {
+		if e.seq == 0 {
+			unassigned = append(unassigned, i)
+		}
+	}
+	if len(unassigned) == 0 {
+		return nil
+	}
+	rows, err := tx.QueryContext(ctx,
+		`SELECT nextval('outbox_seq') FROM generate_series(1, $1);`, len(unassigned))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	seqs := make([]int64, 0, len(unassigned))
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&seq); err != nil {
+			return err
+		}
+		seqs = append(seqs, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(seqs) != len(unassigned) {
+		return fmt.Errorf("drew %d outbox sequences for %d events", len(seqs), len(unassigned))
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for i, idx := range unassigned {
+		events[idx].seq = seqs[i]
+	}
+	return nil
+}
+
+// retries reports whether publishing e should be retried after it failed
+// with publishErr. An event that failed MaxAttempts times, or whose
+// payload can't be decoded, is set aside as failed instead.
+func (r *OutboxRelay) retries(e outboxEvent, publishErr error) bool {
+	_, undecodable := publishErr.(*decodeError)
+	return !undecodable && e.attempts+1 < r.cfg.MaxAttempts
+}
+
+// recordFailure records that publishing e failed with publishErr, setting
+// e aside as failed unless it is retried.
+func (r *OutboxRelay) recordFailure(ctx context.Context, tx *sql.Tx, e outboxEvent, publishErr error) error {
+	attempts := e.attempts + 1
+	if r.retries(e, publishErr) {
+		_, err := tx.ExecContext(ctx,
+			`UPDATE outbox SET attempts = $2, last_error = $3 WHERE id = $1;`,
+			e.id, attempts, publishErr.Error())
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx,
+		`UPDATE outbox SET attempts = $2, last_error = $3, failed_at = now() WHERE id = $1;`,
+		e.id, attempts, publishErr.Error())
+	if err != nil {
+		return err
+	}
+	r.log.Error("giving up on outbox event", "id", e.id, "topic", e.topic,
+		"attempts", attempts, "error", publishErr)
+	return nil
+}
+
+// undelivered reads the next batch of undelivered events: first the ones
+// claimed before, in their delivery order, then the others in the order
+// they were written.
+func (r *OutboxRelay) undelivered(ctx context.Context, tx *sql.Tx) ([]outboxEvent, error) {
+	query := `
+	SELECT
+		id, topic, payload_type, payload, attempts, COALESCE(seq, 0)
+	FROM
+		outbox
+	WHERE
+		delivered_at IS NULL AND failed_at IS NULL
+	ORDER BY seq NULLS LAST, id
+	LIMIT $1;`
+	rows, err := tx.QueryContext(ctx, query, r.cfg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]outboxEvent, 0)
+	for rows.Next() {
+		var e outboxEvent
+		err := rows.Scan(&e.id, &e.topic, &e.payloadType, &e.payload, &e.attempts, &e.seq)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// publishDelivered publishes the events delivered since the last ones a
+// Local relay published. An event failing to publish is logged and
+// skipped: it has already been delivered to the other instances.
+func (r *OutboxRelay) publishDelivered(ctx context.Context) error {
+	query := `
+	SELECT
+		id, topic, payload_type, payload, seq
+	FROM
+		outbox
+	WHERE
+		seq > $1 AND delivered_at IS NOT NULL
+	ORDER BY seq
+	LIMIT $2;`
+	for {
+		rows, err := r.db.QueryContext(ctx, query, r.published, r.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+		events := make([]outboxEvent, 0)
+		for rows.Next() {
+			var e outboxEvent
+			if err := rows.Scan(&e.id, &e.topic, &e.payloadType, &e.payload, &e.seq); err != nil {
+				rows.Close()
+				return err
+			}
+			events = append(events, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			if err := r.publish(ctx, e); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				r.log.Error("failed to publish outbox event", "id", e.id, "topic", e.topic, "error", err)
+			}
+			r.published = e.seq
+		}
+		if len(events) < r.cfg.BatchSize {
+			return nil
+		}
+	}
+}
+
+func (r *OutboxRelay) publish(ctx context.Context, e outboxEvent) error {
+	payload, err := r.cfg.Decode(e.payloadType, e.payload)
+	if err != nil {
+		return &decodeError{err: err}
+	}
+	return r.cfg.Publish(ctx, e.seq, e.topic, payload)
+}
+
+// purge deletes the events delivered or failed before the retention
+// period. The highest sequence deleted is kept in outbox_purged, for the
+// EventLog to tell which events are gone.
+func (r *OutboxRelay) purge(ctx context.Context) {
+	query := `
+	WITH purged AS (
+		DELETE FROM outbox WHERE delivered_at < $1 OR failed_at < $1 RETURNING seq
+	)
+	UPDATE outbox_purged SET seq = GREATEST(seq, (SELECT COALESCE(MAX(seq), 0) FROM purged));`
+	_, err := r.db.ExecContext(ctx, query, time.Now().Add(-r.cfg.Retention))
+	if err != nil && ctx.Err() == nil {
+		r.log.Warn("failed to purge delivered outbox events", "error", err)
+	}
+}
+
+// nextBackoff doubles backoff within [min, max].
+func nextBackoff(backoff, min, max time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < min {
+		return min
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
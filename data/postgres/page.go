@@ -0,0 +1,332 @@
+package postgres
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dikaeinstein/go-graphql-api/data"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultPageSize is the page size used when neither first nor last is given.
+	DefaultPageSize = 20
+	// MaxPageSize is the largest page size that can be requested.
+	MaxPageSize = 100
+)
+
+// ErrInvalidCursor is returned when a pagination cursor is malformed or
+// was issued for a different ordering.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// orderColumn describes the column a list of users is sorted by.
+type orderColumn struct {
+	column string
+	desc   bool
+	value  func(u data.User) interface{}
+}
+
+var userOrders = map[data.UserOrder]orderColumn{
+	data.UserOrderIDAsc:     {column: "id", value: userID},
+	data.UserOrderIDDesc:    {column: "id", desc: true, value: userID},
+	data.UserOrderNameAsc:   {column: "name", value: userName},
+	data.UserOrderNameDesc:  {column: "name", desc: true, value: userName},
+	data.UserOrderAgeAsc:    {column: "age", value: userAge},
+	data.UserOrderAgeDesc:   {column: "age", desc: true, value: userAge},
+	data.UserOrderEmailAsc:  {column: "email", value: userEmail},
+	data.UserOrderEmailDesc: {column: "email", desc: true, value: userEmail},
+}
+
+func userID(u data.User) interface{}    { return u.ID }
+func userName(u data.User) interface{}  { return u.Name }
+func userAge(u data.User) interface{}   { return u.Age }
+func userEmail(u data.User) interface{} { return u.Email }
+
+// GetUsersPage retrieves a page of users using keyset pagination.
+func (p *Postgres) GetUsersPage(ctx context.Context, args data.UserPageArgs) (*data.UserPage, error) {
+	order := args.OrderBy
+	if order == "" {
+		order = data.UserOrderIDAsc
+	}
+	col, ok := userOrders[order]
+	if !ok {
+		return nil, errors.Errorf("GetUsersPage failed: unknown order %q", order)
+	}
+
+	limit, backward, err := pageSize(args)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetUsersPage failed")
+	}
+
+	c := &conditions{}
+	if predicate := userFilterPredicate(c, args.Filter); predicate != "" {
+		c.add(predicate)
+	}
+	if args.After != "" {
+		cur, err := decodeCursor(args.After, order)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetUsersPage failed")
+		}
+		keysetCondition(c, col, cur, true)
+	}
+	if args.Before != "" {
+		cur, err := decodeCursor(args.Before, order)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetUsersPage failed")
+		}
+		keysetCondition(c, col, cur, false)
+	}
+
+	query := fmt.Sprintf(`
+	SELECT
+		id, name, email, age, profession, friendly
+	FROM
+		users
+	%s
+	ORDER BY %s
+	LIMIT %s;`, c.where(), pageOrderBy(col, backward), c.arg(limit+1))
+	rows, err := p.QueryContext(ctx, query, c.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetUsersPage failed")
+	}
+	defer rows.Close()
+
+	users := make([]data.User, 0, limit+1)
+	for rows.Next() {
+		var u data.User
+		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Age,
+			&u.Profession, &u.Friendly)
+		if err != nil {
+			return nil, errors.Wrap(err, "GetUsersPage failed")
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "GetUsersPage failed")
+	}
+
+	hasMore := len(users) > limit
+	if hasMore {
+		users = users[:limit]
+	}
+	if backward {
+		for i, j := 0, len(users)-1; i < j; i, j = i+1, j-1 {
+			users[i], users[j] = users[j], users[i]
+		}
+	}
+
+	page := &data.UserPage{Edges: make([]data.UserEdge, len(users))}
+	for i, u := range users {
+		page.Edges[i] = data.UserEdge{
+			Cursor: encodeCursor(order, col.value(u), u.ID),
+			Node:   u,
+		}
+	}
+	if len(page.Edges) > 0 {
+		page.PageInfo.StartCursor = page.Edges[0].Cursor
+		page.PageInfo.EndCursor = page.Edges[len(page.Edges)-1].Cursor
+	}
+	if backward {
+		page.PageInfo.HasPreviousPage = hasMore
+		page.PageInfo.HasNextPage = args.Before != ""
+	} else {
+		page.PageInfo.HasNextPage = hasMore
+		page.PageInfo.HasPreviousPage = args.After != ""
+	}
+
+	return page, nil
+}
+
+// pageOrderBy returns the ORDER BY clause of a page. Paging backwards
+// walks the list in reverse and the page is flipped after.
+func pageOrderBy(col orderColumn, backward bool) string {
+	direction := "ASC"
+	if col.desc != backward {
+		direction = "DESC"
+	}
+	orderBy := "id " + direction
+	if col.column != "id" {
+		orderBy = col.column + " " + direction + ", " + orderBy
+	}
+	return orderBy
+}
+
+// pageSize returns the number of users to fetch and whether the page is
+// fetched backwards from the end of the list.
+func pageSize(args data.UserPageArgs) (int, bool, error) {
+	switch {
+	case args.First != nil && args.Last != nil:
+		return 0, false, errors.New("first and last cannot be used together")
+	case args.First != nil:
+		return checkPageSize("first", *args.First, false)
+	case args.Last != nil:
+		return checkPageSize("last", *args.Last, true)
+	default:
+		return DefaultPageSize, args.Before != "" && args.After == "", nil
+	}
+}
+
+func checkPageSize(name string, size int, backward bool) (int, bool, error) {
+	if size < 0 || size > MaxPageSize {
+		return 0, false, errors.Errorf("%s must be between 0 and %d", name, MaxPageSize)
+	}
+	return size, backward, nil
+}
+
+// keysetCondition restricts the rows to those after (or before) the cursor
+// in the given order.
+func keysetCondition(c *conditions, col orderColumn, cur *cursor, after bool) {
+	op := ">"
+	if col.desc == after {
+		op = "<"
+	}
+
+	if col.column == "id" {
+		c.add(fmt.Sprintf("id %s %s", op, c.arg(cur.ID)))
+		return
+	}
+	c.add(fmt.Sprintf("(%s, id) %s (%s, %s)", col.column, op, c.arg(cur.Value), c.arg(cur.ID)))
+}
+
+// userFilterPredicate compiles filter into a parameterized SQL predicate,
+// binding its values to c. It returns an empty string when filter matches
+// every user.
+func userFilterPredicate(c *conditions, filter data.UserFilter) string {
+	var predicates []string
+	if filter.NameContains != "" {
+		predicates = append(predicates,
+			"name ILIKE "+c.arg("%"+escapeLike(filter.NameContains)+"%"))
+	}
+	if filter.NameStartsWith != "" {
+		predicates = append(predicates,
+			"name ILIKE "+c.arg(escapeLike(filter.NameStartsWith)+"%"))
+	}
+	if filter.Email != "" {
+		predicates = append(predicates, "email = "+c.arg(filter.Email))
+	}
+	if filter.AgeMin != nil {
+		predicates = append(predicates, "age >= "+c.arg(*filter.AgeMin))
+	}
+	if filter.AgeMax != nil {
+		predicates = append(predicates, "age <= "+c.arg(*filter.AgeMax))
+	}
+	if filter.ProfessionIn != nil {
+		predicates = append(predicates,
+			"profession = ANY("+c.arg(pq.Array(filter.ProfessionIn))+")")
+	}
+	if filter.Friendly != nil {
+		predicates = append(predicates, "friendly = "+c.arg(*filter.Friendly))
+	}
+	for _, f := range filter.And {
+		if predicate := userFilterPredicate(c, f); predicate != "" {
+			predicates = append(predicates, predicate)
+		}
+	}
+
+	// An OR with an alternative that matches every user matches every user.
+	if len(filter.Or) > 0 && !anyMatchesAll(filter.Or) {
+		alternatives := make([]string, len(filter.Or))
+		for i, f := range filter.Or {
+			alternatives[i] = userFilterPredicate(c, f)
+		}
+		predicates = append(predicates, "("+strings.Join(alternatives, " OR ")+")")
+	}
+
+	if len(predicates) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(predicates, " AND ") + ")"
+}
+
+// matchesAll reports whether filter matches every user.
+func matchesAll(filter data.UserFilter) bool {
+	if filter.NameContains != "" || filter.NameStartsWith != "" ||
+		filter.Email != "" || filter.AgeMin != nil || filter.AgeMax != nil ||
+		filter.ProfessionIn != nil || filter.Friendly != nil {
+		return false
+	}
+	for _, f := range filter.And {
+		if !matchesAll(f) {
+			return false
+		}
+	}
+	return len(filter.Or) == 0 || anyMatchesAll(filter.Or)
+}
+
+func anyMatchesAll(filters []data.UserFilter) bool {
+	for _, f := range filters {
+		if matchesAll(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// conditions accumulates SQL predicates and their positional arguments.
+type conditions struct {
+	clauses []string
+	args    []interface{}
+}
+
+// arg binds v to the next positional parameter and returns its placeholder.
+func (c *conditions) arg(v interface{}) string {
+	c.args = append(c.args, v)
+	return fmt.Sprintf("$%d", len(c.args))
+}
+
+// add appends a predicate that must hold for every row.
+func (c *conditions) add(clause string) {
+	c.clauses = append(c.clauses, clause)
+}
+
+// where returns the WHERE clause combining all predicates.
+func (c *conditions) where() string {
+	if len(c.clauses) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(c.clauses, " AND ")
+}
+
+// cursor identifies a position in an ordered list of users.
+type cursor struct {
+	Order data.UserOrder `json:"o"`
+	Value interface{}    `json:"v"`
+	ID    int            `json:"id"`
+}
+
+func encodeCursor(order data.UserOrder, value interface{}, id int) string {
+	b, _ := json.Marshal(cursor{Order: order, Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string, order data.UserOrder) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	var cur cursor
+	if err := dec.Decode(&cur); err != nil || cur.Order != order {
+		return nil, ErrInvalidCursor
+	}
+	if n, ok := cur.Value.(json.Number); ok {
+		v, err := n.Int64()
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		cur.Value = v
+	}
+
+	return &cur, nil
+}
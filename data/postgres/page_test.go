@@ -0,0 +1,187 @@
+package postgres
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dikaeinstein/go-graphql-api/data"
+)
+
+func intPtr(n int) *int { return &n }
+
+func TestPageSize(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         data.UserPageArgs
+		wantLimit    int
+		wantBackward bool
+		wantErr      bool
+	}{
+		{name: "default", args: data.UserPageArgs{}, wantLimit: DefaultPageSize},
+		{name: "first", args: data.UserPageArgs{First: intPtr(5)}, wantLimit: 5},
+		{name: "last", args: data.UserPageArgs{Last: intPtr(5)}, wantLimit: 5, wantBackward: true},
+		{name: "before without size", args: data.UserPageArgs{Before: "c"}, wantLimit: DefaultPageSize, wantBackward: true},
+		{name: "first and last", args: data.UserPageArgs{First: intPtr(5), Last: intPtr(5)}, wantErr: true},
+		{name: "too large", args: data.UserPageArgs{First: intPtr(MaxPageSize + 1)}, wantErr: true},
+		{name: "negative", args: data.UserPageArgs{Last: intPtr(-1)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, backward, err := pageSize(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pageSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if limit != tt.wantLimit || backward != tt.wantBackward {
+				t.Errorf("pageSize() = %d, %v, want %d, %v", limit, backward, tt.wantLimit, tt.wantBackward)
+			}
+		})
+	}
+}
+
+func TestPageOrderBy(t *testing.T) {
+	tests := []struct {
+		order    data.UserOrder
+		backward bool
+		want     string
+	}{
+		{data.UserOrderIDAsc, false, "id ASC"},
+		{data.UserOrderIDAsc, true, "id DESC"},
+		{data.UserOrderIDDesc, false, "id DESC"},
+		{data.UserOrderIDDesc, true, "id ASC"},
+		{data.UserOrderNameDesc, false, "name DESC, id DESC"},
+		{data.UserOrderNameDesc, true, "name ASC, id ASC"},
+	}
+
+	for _, tt := range tests {
+		if got := pageOrderBy(userOrders[tt.order], tt.backward); got != tt.want {
+			t.Errorf("pageOrderBy(%s, %v) = %q, want %q", tt.order, tt.backward, got, tt.want)
+		}
+	}
+}
+
+func TestKeysetCondition(t *testing.T) {
+	tests := []struct {
+		name  string
+		order data.UserOrder
+		after bool
+		want  string
+	}{
+		{name: "after ascending id", order: data.UserOrderIDAsc, after: true, want: "id > $1"},
+		{name: "before ascending id", order: data.UserOrderIDAsc, after: false, want: "id < $1"},
+		{name: "after descending age", order: data.UserOrderAgeDesc, after: true, want: "(age, id) < ($1, $2)"},
+		{name: "before descending age", order: data.UserOrderAgeDesc, after: false, want: "(age, id) > ($1, $2)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &conditions{}
+			keysetCondition(c, userOrders[tt.order], &cursor{Value: int64(30), ID: 4}, tt.after)
+			if got := c.where(); got != "WHERE "+tt.want {
+				t.Errorf("keysetCondition() = %q, want %q", got, "WHERE "+tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCursor(t *testing.T) {
+	s := encodeCursor(data.UserOrderAgeAsc, 30, 4)
+
+	cur, err := decodeCursor(s, data.UserOrderAgeAsc)
+	if err != nil {
+		t.Fatalf("decodeCursor() error = %v", err)
+	}
+	if cur.Value != int64(30) || cur.ID != 4 {
+		t.Errorf("decodeCursor() = %+v, want value 30 and id 4", cur)
+	}
+
+	if _, err := decodeCursor(s, data.UserOrderNameAsc); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("decodeCursor() with another order error = %v, want ErrInvalidCursor", err)
+	}
+	if _, err := decodeCursor("not a cursor!", data.UserOrderAgeAsc); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("decodeCursor() of garbage error = %v, want ErrInvalidCursor", err)
+	}
+}
+
+func TestUserFilterPredicate(t *testing.T) {
+	friendly := true
+	tests := []struct {
+		name     string
+		filter   data.UserFilter
+		want     string
+		wantArgs int
+	}{
+		{name: "empty", filter: data.UserFilter{}, want: ""},
+		{
+			name:     "fields",
+			filter:   data.UserFilter{NameStartsWith: "ke", AgeMin: intPtr(18), Friendly: &friendly},
+			want:     "(name ILIKE $1 AND age >= $2 AND friendly = $3)",
+			wantArgs: 3,
+		},
+		{
+			name: "nested and/or numbering",
+			filter: data.UserFilter{
+				Email: "a@b.c",
+				And:   []data.UserFilter{{AgeMax: intPtr(60)}},
+				Or: []data.UserFilter{
+					{NameContains: "kev"},
+					{AgeMin: intPtr(18), Or: []data.UserFilter{{Email: "x@y.z"}, {Email: "z@y.x"}}},
+				},
+			},
+			want: "(email = $1 AND (age <= $2) AND ((name ILIKE $3) OR " +
+				"(age >= $4 AND ((email = $5) OR (email = $6)))))",
+			wantArgs: 6,
+		},
+		{
+			name:   "or with an alternative matching all",
+			filter: data.UserFilter{Or: []data.UserFilter{{NameContains: "kev"}, {}}},
+			want:   "",
+		},
+		{
+			name: "or with a nested alternative matching all",
+			filter: data.UserFilter{
+				AgeMin: intPtr(18),
+				Or:     []data.UserFilter{{Email: "a@b.c"}, {And: []data.UserFilter{{}}}},
+			},
+			want:     "(age >= $1)",
+			wantArgs: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &conditions{}
+			if got := userFilterPredicate(c, tt.filter); got != tt.want {
+				t.Errorf("userFilterPredicate() = %q, want %q", got, tt.want)
+			}
+			if len(c.args) != tt.wantArgs {
+				t.Errorf("userFilterPredicate() bound %d args, want %d", len(c.args), tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestUserFilterPredicateEscapesLike(t *testing.T) {
+	c := &conditions{}
+	userFilterPredicate(c, data.UserFilter{NameContains: `50%_off\`})
+	if want := `%50\%\_off\\%`; c.args[0] != want {
+		t.Errorf("userFilterPredicate() bound %q, want %q", c.args[0], want)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"kevin":   "kevin",
+		"100%":    `100\%`,
+		"a_b":     `a\_b`,
+		`back\sl`: `back\\sl`,
+	}
+	for in, want := range tests {
+		if got := escapeLike(in); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
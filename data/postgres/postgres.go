@@ -1,27 +1,93 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dikaeinstein/go-graphql-api/logger"
 )
 
 // Postgres represents the postgres db.
 type Postgres struct {
 	*sql.DB
+	log *logger.Logger
+	// outboxWritten wakes the outbox relay up when events are written.
+	outboxWritten chan struct{}
+}
+
+// PoolConfig configures the connection pool. Zero values keep the
+// database/sql defaults.
+type PoolConfig struct {
+	// MaxOpenConns is the maximum number of open connections.
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections.
+	MaxIdleConns int
+	// ConnMaxLifetime is the maximum time a connection may be reused.
+	ConnMaxLifetime time.Duration
 }
 
-// New opens and returns a postgres DB.
-func New(connStr string) (*Postgres, error) {
+// New opens and returns a postgres DB. connStr is either a connection
+// string built by ConnString or a postgres:// URL. Queries are logged at
+// debug level with the logger of their context, or log.
+func New(connStr string, pool PoolConfig, log *logger.Logger) (*Postgres, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	if pool.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
 
 	if err = db.Ping(); err != nil {
 		return nil, err
 	}
 
-	return &Postgres{db}, nil
+	return &Postgres{DB: db, log: log, outboxWritten: make(chan struct{}, 1)}, nil
+}
+
+// QueryContext executes a query that returns rows.
+func (p *Postgres) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := p.DB.QueryContext(ctx, query, args...)
+	p.logQuery(ctx, query, start, err)
+	return rows, err
+}
+
+// QueryRowContext executes a query that returns at most one row.
+func (p *Postgres) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := p.DB.QueryRowContext(ctx, query, args...)
+	p.logQuery(ctx, query, start, nil)
+	return row
+}
+
+// ExecContext executes a query without returning any rows.
+func (p *Postgres) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := p.DB.ExecContext(ctx, query, args...)
+	p.logQuery(ctx, query, start, err)
+	return result, err
+}
+
+// logQuery logs a query without its arguments, which may hold personal
+// data. Failed queries are logged at warn level, the others at debug.
+func (p *Postgres) logQuery(ctx context.Context, query string, start time.Time, err error) {
+	log := logger.FromContext(ctx, p.log)
+	if err == nil && !log.Enabled(logger.DebugLevel) {
+		return
+	}
+
+	query = strings.Join(strings.Fields(query), " ")
+	if err != nil {
+		log.Warn("query failed", "query", query, "duration", time.Since(start), "error", err)
+		return
+	}
+	log.Debug("query executed", "query", query, "duration", time.Since(start))
 }
 
 type connParams struct {
@@ -56,10 +122,30 @@ func ConnString(dbName, user string, options ...Option) string {
 		option(cp)
 	}
 
-	return fmt.Sprintf(
-		"host=%s port=%d user=%s dbname=%s sslmode=%s connect_timeout=%d",
-		cp.host, cp.port, cp.user, cp.dbName, cp.sslMode, cp.connectTimeout,
+	params := []string{
+		"host=" + quoteConnValue(cp.host),
+		fmt.Sprintf("port=%d", cp.port),
+		"user=" + quoteConnValue(cp.user),
+	}
+	if cp.password != "" {
+		params = append(params, "password="+quoteConnValue(cp.password))
+	}
+	params = append(params,
+		"dbname="+quoteConnValue(cp.dbName),
+		"sslmode="+quoteConnValue(cp.sslMode),
+		fmt.Sprintf("connect_timeout=%d", cp.connectTimeout),
 	)
+	return strings.Join(params, " ")
+}
+
+// quoteConnValue quotes a connection string value when it is empty or
+// contains spaces, quotes or backslashes.
+func quoteConnValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + value + "'"
 }
 
 // Host option sets the host connection string param.
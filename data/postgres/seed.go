@@ -0,0 +1,32 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Seed inserts the development fixture users. Existing rows are left as is,
+// so it is safe to run more than once.
+func (p *Postgres) Seed(ctx context.Context) error {
+	query := `
+	INSERT INTO users(id, name, email, age, profession, friendly) VALUES
+		(1, 'kevin', 'kevin@email.com', 35, 'waiter', true),
+		(2, 'angela', 'angela@email.com', 21, 'concierge', true),
+		(3, 'alex', 'alex@email.com', 26, 'zoo keeper', false),
+		(4, 'becky', 'becky@email.com', 67, 'retired', false),
+		(5, 'kevin', 'kevin2@email.com', 15, 'in school', true),
+		(6, 'frankie', 'frankie@email.com', 45, 'teller', true)
+	ON CONFLICT DO NOTHING;`
+	if _, err := p.ExecContext(ctx, query); err != nil {
+		return errors.Wrap(err, "Seed failed")
+	}
+
+	// keep the id sequence ahead of the explicitly inserted ids
+	query = `SELECT setval('users_id_seq', (SELECT MAX(id) FROM users));`
+	if _, err := p.ExecContext(ctx, query); err != nil {
+		return errors.Wrap(err, "Seed failed")
+	}
+
+	return nil
+}
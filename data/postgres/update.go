@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrEmptyUpdate is returned when an update payload contains no fields.
+var ErrEmptyUpdate = errors.New("update payload contains no fields")
+
+// UnknownFieldError is returned when an update payload contains a field
+// that does not map to an updatable column.
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q", e.Field)
+}
+
+// NullValueError is returned when an update payload sets a non-nullable
+// column to NULL.
+type NullValueError struct {
+	Field string
+}
+
+func (e *NullValueError) Error() string {
+	return fmt.Sprintf("field %q cannot be null", e.Field)
+}
+
+// Column describes a table column that can be written by an UpdateBuilder.
+type Column struct {
+	Name     string
+	Nullable bool
+}
+
+// UpdateBuilder builds parameterized UPDATE statements for a single table.
+// Only fields present in its column whitelist are accepted. A field that is
+// absent from the payload is left unchanged, while a field explicitly set to
+// nil is written as NULL.
+type UpdateBuilder struct {
+	table     string
+	keyColumn string
+	columns   map[string]Column
+	returning []string
+}
+
+// NewUpdateBuilder creates an UpdateBuilder for the given table. Rows are
+// matched on keyColumn and columns maps payload field names to table columns.
+func NewUpdateBuilder(table, keyColumn string, columns map[string]Column) *UpdateBuilder {
+	return &UpdateBuilder{
+		table:     table,
+		keyColumn: keyColumn,
+		columns:   columns,
+		returning: []string{"*"},
+	}
+}
+
+// Returning sets the columns returned by the built statement.
+func (b *UpdateBuilder) Returning(columns ...string) *UpdateBuilder {
+	b.returning = columns
+	return b
+}
+
+// Build returns the UPDATE statement and its arguments for the row matching
+// key. The key is always bound to $1 and payload values follow in field name
+// order.
+func (b *UpdateBuilder) Build(key interface{}, payload map[string]interface{}) (string, []interface{}, error) {
+	if len(payload) == 0 {
+		return "", nil, ErrEmptyUpdate
+	}
+
+	fields := make([]string, 0, len(payload))
+	for field := range payload {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	args := []interface{}{key}
+	assignments := make([]string, 0, len(fields))
+	for _, field := range fields {
+		column, ok := b.columns[field]
+		if !ok {
+			return "", nil, &UnknownFieldError{Field: field}
+		}
+
+		value := payload[field]
+		if value == nil {
+			if !column.Nullable {
+				return "", nil, &NullValueError{Field: field}
+			}
+			assignments = append(assignments, column.Name+" = NULL")
+			continue
+		}
+
+		args = append(args, value)
+		assignments = append(assignments, fmt.Sprintf("%s = $%d", column.Name, len(args)))
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = $1 RETURNING %s;",
+		b.table, strings.Join(assignments, ", "), b.keyColumn,
+		strings.Join(b.returning, ", "))
+	return query, args, nil
+}
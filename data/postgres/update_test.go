@@ -0,0 +1,74 @@
+package postgres
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var testColumns = map[string]Column{
+	"name":     {Name: "name"},
+	"age":      {Name: "age"},
+	"nickname": {Name: "nick_name", Nullable: true},
+}
+
+func TestUpdateBuilderBuild(t *testing.T) {
+	b := NewUpdateBuilder("users", "id", testColumns).Returning("id", "name")
+
+	tests := []struct {
+		name      string
+		payload   map[string]interface{}
+		wantQuery string
+		wantArgs  []interface{}
+		wantErr   error
+	}{
+		{
+			name:      "fields numbered in sorted order",
+			payload:   map[string]interface{}{"name": "kevin", "age": 35},
+			wantQuery: "UPDATE users SET age = $2, name = $3 WHERE id = $1 RETURNING id, name;",
+			wantArgs:  []interface{}{7, 35, "kevin"},
+		},
+		{
+			name:      "nil writes NULL to a nullable column",
+			payload:   map[string]interface{}{"nickname": nil, "name": "kevin"},
+			wantQuery: "UPDATE users SET name = $2, nick_name = NULL WHERE id = $1 RETURNING id, name;",
+			wantArgs:  []interface{}{7, "kevin"},
+		},
+		{
+			name:    "empty payload",
+			payload: map[string]interface{}{},
+			wantErr: ErrEmptyUpdate,
+		},
+		{
+			name:    "unknown field",
+			payload: map[string]interface{}{"name": "kevin", "id": 8},
+			wantErr: &UnknownFieldError{Field: "id"},
+		},
+		{
+			name:    "nil on a non-nullable column",
+			payload: map[string]interface{}{"age": nil},
+			wantErr: &NullValueError{Field: "age"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, err := b.Build(7, tt.payload)
+			if tt.wantErr != nil {
+				if !reflect.DeepEqual(err, tt.wantErr) && !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Build() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("Build() query = %q, want %q", query, tt.wantQuery)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("Build() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
@@ -2,12 +2,24 @@ package postgres
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/dikaeinstein/go-graphql-api/data"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
+// userColumns whitelists the user fields that can be written by UpdateUser.
+var userColumns = map[string]Column{
+	"name":       {Name: "name"},
+	"email":      {Name: "email"},
+	"age":        {Name: "age"},
+	"profession": {Name: "profession"},
+	"friendly":   {Name: "friendly"},
+}
+
+var userUpdateBuilder = NewUpdateBuilder("users", "id", userColumns).
+	Returning("id", "name", "email", "age", "profession", "friendly")
+
 // GetUsersByName retrieves users with name matching the given name.
 func (p *Postgres) GetUsersByName(ctx context.Context, name string) ([]data.User, error) {
 	query := `
@@ -58,74 +70,172 @@ func (p *Postgres) GetUserByEmail(ctx context.Context, email string) (*data.User
 	return &u, nil
 }
 
-// CreateUser creates a new user and returns the ID.
-func (p *Postgres) CreateUser(ctx context.Context, u data.User) (*data.User, error) {
+// GetUsersByEmails retrieves the users with any of the given emails.
+func (p *Postgres) GetUsersByEmails(ctx context.Context, emails []string) ([]data.User, error) {
+	query := `
+	SELECT
+		id, name, email, age, profession, friendly
+	FROM
+		users
+	WHERE
+		email = ANY($1);`
+	users, err := p.queryUsers(ctx, query, pq.Array(emails))
+	return users, errors.Wrap(err, "GetUsersByEmails failed")
+}
+
+// GetUsersByIDs retrieves the users with any of the given IDs.
+func (p *Postgres) GetUsersByIDs(ctx context.Context, ids []int) ([]data.User, error) {
+	query := `
+	SELECT
+		id, name, email, age, profession, friendly
+	FROM
+		users
+	WHERE
+		id = ANY($1);`
+	users, err := p.queryUsers(ctx, query, pq.Array(ids))
+	return users, errors.Wrap(err, "GetUsersByIDs failed")
+}
+
+func (p *Postgres) queryUsers(ctx context.Context, query string, args ...interface{}) ([]data.User, error) {
+	rows, err := p.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]data.User, 0)
+	for rows.Next() {
+		var u data.User
+		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Age,
+			&u.Profession, &u.Friendly)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// CreateUser creates a new user and returns it. The events built from
+// the new user are written to the outbox in the same transaction.
+func (p *Postgres) CreateUser(ctx context.Context, u data.User,
+	events func(data.User) []data.Event) (*data.User, error) {
+	tx, err := p.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "CreateUser failed")
+	}
+	defer tx.Rollback()
+
 	query := `
 	INSERT INTO users(name, email, age, profession, friendly)
 	VALUES($1, $2, $3, $4, $5)
 	RETURNING *;`
-	row := p.QueryRowContext(ctx, query,
+	row := tx.QueryRowContext(ctx, query,
 		u.Name, u.Email, u.Age, u.Profession, u.Friendly,
 	)
 
 	var newUser data.User
-	err := row.Scan(&newUser.ID, &newUser.Name, &newUser.Email, &newUser.Age,
+	err = row.Scan(&newUser.ID, &newUser.Name, &newUser.Email, &newUser.Age,
 		&newUser.Profession, &newUser.Friendly)
 	if err != nil {
 		return nil, errors.Wrap(err, "CreateUser failed")
 	}
 
+	var outbox []data.Event
+	if events != nil {
+		outbox = events(newUser)
+	}
+	if err := p.commitWithEvents(ctx, tx, outbox); err != nil {
+		return nil, errors.Wrap(err, "CreateUser failed")
+	}
+
 	return &newUser, nil
 }
 
-// UpdateUser updates the user that matches `id` with given `payload`.
-func (p *Postgres) UpdateUser(ctx context.Context, id int,
-	payload map[string]interface{}) (*data.User, error) {
-	query := prepareUpdateQuery(payload)
-	row := p.QueryRowContext(ctx, query, id)
+// UpdateUser updates the user that matches `id` with given `payload` and
+// returns the user as it was before and after the update. The events
+// built from the change are written to the outbox in the same
+// transaction.
+func (p *Postgres) UpdateUser(ctx context.Context, id int, payload map[string]interface{},
+	events func(data.UserChange) []data.Event) (*data.UserChange, error) {
+	query, args, err := userUpdateBuilder.Build(id, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "UpdateUser failed")
+	}
 
-	var u data.User
-	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Age,
-		&u.Profession, &u.Friendly)
+	tx, err := p.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "UpdateUser failed")
 	}
+	defer tx.Rollback()
 
-	return &u, nil
+	var change data.UserChange
+	selectQuery := `
+	SELECT
+		id, name, email, age, profession, friendly
+	FROM
+		users
+	WHERE
+		id = $1
+	FOR UPDATE;`
+	b := &change.Before
+	err = tx.QueryRowContext(ctx, selectQuery, id).Scan(&b.ID, &b.Name,
+		&b.Email, &b.Age, &b.Profession, &b.Friendly)
+	if err != nil {
+		return nil, errors.Wrap(err, "UpdateUser failed")
+	}
+
+	a := &change.After
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&a.ID, &a.Name,
+		&a.Email, &a.Age, &a.Profession, &a.Friendly)
+	if err != nil {
+		return nil, errors.Wrap(err, "UpdateUser failed")
+	}
+
+	var outbox []data.Event
+	if events != nil {
+		outbox = events(change)
+	}
+	if err := p.commitWithEvents(ctx, tx, outbox); err != nil {
+		return nil, errors.Wrap(err, "UpdateUser failed")
+	}
+
+	return &change, nil
 }
 
-// DeleteUser deletes the user that matches `id` from data store.
-func (p *Postgres) DeleteUser(ctx context.Context, id int) (*data.User, error) {
+// DeleteUser deletes the user that matches `id` from data store. The
+// events built from the deleted user are written to the outbox in the
+// same transaction.
+func (p *Postgres) DeleteUser(ctx context.Context, id int,
+	events func(data.User) []data.Event) (*data.User, error) {
+	tx, err := p.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "DeleteUser failed")
+	}
+	defer tx.Rollback()
+
 	query := `
 	DELETE FROM users
 	WHERE
-		id = $
+		id = $1
 	RETURNING *;`
-	row := p.QueryRowContext(ctx, query, id)
+	row := tx.QueryRowContext(ctx, query, id)
 
 	var u data.User
-	err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Age,
+	err = row.Scan(&u.ID, &u.Name, &u.Email, &u.Age,
 		&u.Profession, &u.Friendly)
 	if err != nil {
 		return nil, errors.Wrap(err, "DeleteUser failed")
 	}
 
-	return &u, nil
-}
-
-func prepareUpdateQuery(payload map[string]interface{}) string {
-	query := "UPDATE users SET"
-	for k, v := range payload {
-		switch x := v.(type) {
-		case int:
-			query += fmt.Sprintf(" %s = %d,", k, x)
-		case bool:
-			query += fmt.Sprintf(" %s = %t,", k, x)
-		case string:
-			query += fmt.Sprintf(" %s = '%s',", k, x)
-		}
+	var outbox []data.Event
+	if events != nil {
+		outbox = events(u)
 	}
-	// strip out trailing comma
-	query = query[:len(query)-2] + " WHERE id = $1 RETURNING *;"
-	return query
+	if err := p.commitWithEvents(ctx, tx, outbox); err != nil {
+		return nil, errors.Wrap(err, "DeleteUser failed")
+	}
+
+	return &u, nil
 }
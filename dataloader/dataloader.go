@@ -0,0 +1,144 @@
+// Package dataloader batches and caches lookups made while resolving a
+// single GraphQL request.
+package dataloader
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// metrics aggregates the counters of every loader, keyed by loader name.
+var metrics = expvar.NewMap("dataloader")
+
+// Result is the outcome of loading a single key.
+type Result struct {
+	Value interface{}
+	Err   error
+}
+
+// BatchFunc loads the values of keys in a single round trip.
+// It must return exactly one Result per key, in the same order as keys.
+type BatchFunc func(ctx context.Context, keys []interface{}) []Result
+
+// Config configures a Loader.
+type Config struct {
+	// Name identifies the loader in the exported metrics.
+	Name string
+	// Wait is how long a batch collects keys before it is dispatched.
+	// A batch is dispatched earlier as soon as one of its results is needed.
+	Wait time.Duration
+	// MaxBatch is the maximum number of keys in a batch.
+	// Zero means no limit.
+	MaxBatch int
+}
+
+// Loader batches the keys requested within a short window into a single
+// call to its BatchFunc and caches the results, so every key is loaded at
+// most once. A Loader is meant to live for a single request.
+type Loader struct {
+	ctx   context.Context
+	fetch BatchFunc
+	cfg   Config
+
+	mu    sync.Mutex
+	cache map[interface{}]func() (interface{}, error)
+	batch *batch
+}
+
+type batch struct {
+	keys    []interface{}
+	results []Result
+	timer   *time.Timer
+	once    sync.Once
+}
+
+// New creates a Loader that runs fetch with ctx.
+func New(ctx context.Context, fetch BatchFunc, cfg Config) *Loader {
+	return &Loader{
+		ctx:   ctx,
+		fetch: fetch,
+		cfg:   cfg,
+		cache: make(map[interface{}]func() (interface{}, error)),
+	}
+}
+
+// Load loads the value of key, blocking until its batch has been fetched.
+func (l *Loader) Load(key interface{}) (interface{}, error) {
+	return l.LoadThunk(key)()
+}
+
+// LoadThunk queues key for loading and returns a thunk that blocks until
+// the value is available. Keys requested before any thunk is called are
+// fetched together.
+func (l *Loader) LoadThunk(key interface{}) func() (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	metrics.Add(l.cfg.Name+".loads", 1)
+	if thunk, ok := l.cache[key]; ok {
+		metrics.Add(l.cfg.Name+".cache_hits", 1)
+		return thunk
+	}
+
+	if l.batch == nil {
+		b := &batch{}
+		b.timer = time.AfterFunc(l.cfg.Wait, func() { l.dispatch(b) })
+		l.batch = b
+	}
+	b := l.batch
+	pos := len(b.keys)
+	b.keys = append(b.keys, key)
+	if l.cfg.MaxBatch > 0 && len(b.keys) >= l.cfg.MaxBatch {
+		l.batch = nil
+		go l.dispatch(b)
+	}
+
+	var once sync.Once
+	var res Result
+	thunk := func() (interface{}, error) {
+		once.Do(func() {
+			l.dispatch(b)
+			res = b.results[pos]
+		})
+		return res.Value, res.Err
+	}
+	l.cache[key] = thunk
+	return thunk
+}
+
+// Prime adds value to the cache for key unless key is already cached.
+func (l *Loader) Prime(key interface{}, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.cache[key]; !ok {
+		l.cache[key] = func() (interface{}, error) { return value, nil }
+	}
+}
+
+// dispatch fetches the batch once; concurrent callers wait for the result.
+func (l *Loader) dispatch(b *batch) {
+	b.once.Do(func() {
+		l.mu.Lock()
+		b.timer.Stop()
+		if l.batch == b {
+			l.batch = nil
+		}
+		l.mu.Unlock()
+
+		metrics.Add(l.cfg.Name+".batches", 1)
+		metrics.Add(l.cfg.Name+".keys", int64(len(b.keys)))
+		results := l.fetch(l.ctx, b.keys)
+		if len(results) != len(b.keys) {
+			err := errors.New("dataloader: batch function returned wrong number of results")
+			results = make([]Result, len(b.keys))
+			for i := range results {
+				results[i].Err = err
+			}
+		}
+		b.results = results
+	})
+}
@@ -0,0 +1,190 @@
+package dataloader
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingFetch is a BatchFunc doubling integer keys that records the
+// batches it is called with.
+type countingFetch struct {
+	mu      sync.Mutex
+	batches [][]interface{}
+}
+
+func (f *countingFetch) fetch(ctx context.Context, keys []interface{}) []Result {
+	f.mu.Lock()
+	f.batches = append(f.batches, append([]interface{}(nil), keys...))
+	f.mu.Unlock()
+
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		results[i].Value = key.(int) * 2
+	}
+	return results
+}
+
+func (f *countingFetch) calls() [][]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.batches
+}
+
+func TestLoaderBatchesAndDeduplicates(t *testing.T) {
+	f := &countingFetch{}
+	l := New(context.Background(), f.fetch, Config{Name: "test", Wait: time.Hour})
+
+	thunks := []func() (interface{}, error){
+		l.LoadThunk(1), l.LoadThunk(2), l.LoadThunk(1), l.LoadThunk(3),
+	}
+	for i, want := range []int{2, 4, 2, 6} {
+		v, err := thunks[i]()
+		if err != nil || v != want {
+			t.Errorf("thunk %d = %v, %v, want %d", i, v, err, want)
+		}
+	}
+
+	batches := f.calls()
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Fatalf("batches = %v, want a single batch of 3 keys", batches)
+	}
+
+	// cached keys are not fetched again
+	if v, _ := l.Load(2); v != 4 {
+		t.Errorf("Load(2) = %v, want 4", v)
+	}
+	if n := len(f.calls()); n != 1 {
+		t.Errorf("fetched %d batches after a cached load, want 1", n)
+	}
+}
+
+func TestLoaderDispatchesAfterWait(t *testing.T) {
+	f := &countingFetch{}
+	l := New(context.Background(), f.fetch, Config{Name: "test", Wait: time.Millisecond})
+
+	l.LoadThunk(1)
+	l.LoadThunk(2)
+	deadline := time.Now().Add(time.Second)
+	for len(f.calls()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if batches := f.calls(); len(batches) != 1 || len(batches[0]) != 2 {
+		t.Errorf("batches = %v, want a single batch of 2 keys", batches)
+	}
+}
+
+func TestLoaderSplitsMaxBatch(t *testing.T) {
+	f := &countingFetch{}
+	l := New(context.Background(), f.fetch, Config{Name: "test", Wait: time.Hour, MaxBatch: 2})
+
+	var thunks []func() (interface{}, error)
+	for key := 1; key <= 5; key++ {
+		thunks = append(thunks, l.LoadThunk(key))
+	}
+	for i, thunk := range thunks {
+		if v, err := thunk(); err != nil || v != (i+1)*2 {
+			t.Errorf("thunk %d = %v, %v, want %d", i, v, err, (i+1)*2)
+		}
+	}
+
+	batches := f.calls()
+	if len(batches) != 3 {
+		t.Fatalf("fetched %d batches, want 3", len(batches))
+	}
+	for _, b := range batches {
+		if len(b) > 2 {
+			t.Errorf("batch %v exceeds MaxBatch", b)
+		}
+	}
+}
+
+func TestLoaderWrongResultCount(t *testing.T) {
+	fetch := func(ctx context.Context, keys []interface{}) []Result {
+		return []Result{{Value: 1}}
+	}
+	l := New(context.Background(), fetch, Config{Name: "test", Wait: time.Hour})
+
+	a, b := l.LoadThunk(1), l.LoadThunk(2)
+	for _, thunk := range []func() (interface{}, error){a, b} {
+		if _, err := thunk(); err == nil {
+			t.Error("thunk error = nil, want wrong number of results error")
+		}
+	}
+}
+
+func TestLoaderPrime(t *testing.T) {
+	f := &countingFetch{}
+	l := New(context.Background(), f.fetch, Config{Name: "test", Wait: time.Hour})
+
+	l.Prime(1, 100)
+	l.Prime(1, 200)
+	if v, _ := l.Load(1); v != 100 {
+		t.Errorf("Load(1) = %v, want the first primed value 100", v)
+	}
+	if n := len(f.calls()); n != 0 {
+		t.Errorf("fetched %d batches for a primed key, want 0", n)
+	}
+}
+
+func TestLoaderCrossPrime(t *testing.T) {
+	// byName and byID prime each other, like the user loaders
+	var byName, byID *Loader
+	var mu sync.Mutex
+	idFetches := 0
+	byName = New(context.Background(), func(ctx context.Context, keys []interface{}) []Result {
+		results := make([]Result, len(keys))
+		for i, key := range keys {
+			id := len(key.(string))
+			byID.Prime(id, key)
+			results[i].Value = id
+		}
+		return results
+	}, Config{Name: "byName", Wait: time.Hour})
+	byID = New(context.Background(), func(ctx context.Context, keys []interface{}) []Result {
+		mu.Lock()
+		idFetches++
+		mu.Unlock()
+		return make([]Result, len(keys))
+	}, Config{Name: "byID", Wait: time.Hour})
+
+	if v, _ := byName.Load("kevin"); v != 5 {
+		t.Fatalf("byName.Load() = %v, want 5", v)
+	}
+	if v, _ := byID.Load(5); v != "kevin" {
+		t.Errorf("byID.Load(5) = %v, want the primed kevin", v)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if idFetches != 0 {
+		t.Errorf("byID fetched %d batches, want 0", idFetches)
+	}
+}
+
+func TestLoaderConcurrentLoads(t *testing.T) {
+	f := &countingFetch{}
+	l := New(context.Background(), f.fetch, Config{Name: "test", Wait: time.Millisecond, MaxBatch: 8})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			if v, err := l.Load(key % 20); err != nil || v != (key%20)*2 {
+				t.Errorf("Load(%d) = %v, %v", key%20, v, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[interface{}]bool)
+	for _, b := range f.calls() {
+		for _, key := range b {
+			if seen[key] {
+				t.Errorf("key %v fetched twice", key)
+			}
+			seen[key] = true
+		}
+	}
+}
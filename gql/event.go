@@ -0,0 +1,141 @@
+package gql
+
+import (
+	"strconv"
+
+	"github.com/dikaeinstein/go-graphql-api/data"
+	"github.com/graphql-go/graphql"
+)
+
+// Topics the resolver publishes user events to.
+const (
+	TopicUserCreated = "userCreated"
+	TopicUserUpdated = "userUpdated"
+	TopicUserDeleted = "userDeleted"
+	TopicUserChanged = "userChanged"
+)
+
+// userTopic returns the topic of events about the user with the given id,
+// e.g. userUpdated.42.
+func userTopic(topic string, id int) string {
+	return topic + "." + strconv.Itoa(id)
+}
+
+// anyUserTopic returns the topic matching the events about every user,
+// e.g. userUpdated.*.
+func anyUserTopic(topic string) string {
+	return topic + ".*"
+}
+
+// UserCreatedEvent is published when a user is created.
+type UserCreatedEvent struct {
+	User data.User
+}
+
+// UserUpdatedEvent is published when a user is updated.
+type UserUpdatedEvent struct {
+	Before        data.User
+	After         data.User
+	ChangedFields []string
+}
+
+// UserDeletedEvent is published when a user is deleted.
+type UserDeletedEvent struct {
+	User data.User
+}
+
+// userCreatedEvents returns the events published when u is created.
+func userCreatedEvents(u data.User) []data.Event {
+	return []data.Event{
+		{Topic: TopicUserCreated, Payload: &u},
+		{Topic: TopicUserChanged, Payload: UserCreatedEvent{User: u}},
+	}
+}
+
+// userUpdatedEvents returns the events published when a user is updated.
+func userUpdatedEvents(change data.UserChange) []data.Event {
+	event := UserUpdatedEvent{
+		Before:        change.Before,
+		After:         change.After,
+		ChangedFields: change.ChangedFields(),
+	}
+	return []data.Event{
+		{Topic: userTopic(TopicUserUpdated, change.After.ID), Payload: event},
+		{Topic: TopicUserChanged, Payload: event},
+	}
+}
+
+// userDeletedEvents returns the events published when u is deleted.
+func userDeletedEvents(u data.User) []data.Event {
+	return []data.Event{
+		{Topic: userTopic(TopicUserDeleted, u.ID), Payload: &u},
+		{Topic: TopicUserChanged, Payload: UserDeletedEvent{User: u}},
+	}
+}
+
+// EventPayloads returns samples of the payloads the resolver publishes,
+// for the pubsubs that must know their types to carry them between
+// servers.
+func EventPayloads() []interface{} {
+	return []interface{}{&data.User{}, UserCreatedEvent{}, UserUpdatedEvent{}, UserDeletedEvent{}}
+}
+
+var userCreatedType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name:        "UserCreated",
+		Description: "UserCreated is emitted when a user is created",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{Type: graphql.NewNonNull(userType)},
+		},
+	},
+)
+
+var userUpdatedType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name:        "UserUpdated",
+		Description: "UserUpdated is emitted when a user is updated",
+		Fields: graphql.Fields{
+			"before": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "The user before the update",
+			},
+			"after": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "The user after the update",
+			},
+			"changedFields": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+				Description: "Names of the fields whose value changed",
+			},
+		},
+	},
+)
+
+var userDeletedType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name:        "UserDeleted",
+		Description: "UserDeleted is emitted when a user is deleted",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{Type: graphql.NewNonNull(userType)},
+		},
+	},
+)
+
+var userChangedType = graphql.NewUnion(
+	graphql.UnionConfig{
+		Name:        "UserChanged",
+		Description: "UserChanged is any event that changes a user",
+		Types:       []*graphql.Object{userCreatedType, userUpdatedType, userDeletedType},
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			switch p.Value.(type) {
+			case UserCreatedEvent:
+				return userCreatedType
+			case UserUpdatedEvent:
+				return userUpdatedType
+			case UserDeletedEvent:
+				return userDeletedType
+			}
+			return nil
+		},
+	},
+)
@@ -1,6 +1,8 @@
 package gql
 
 import (
+	"github.com/dikaeinstein/go-graphql-api/data"
+	"github.com/dikaeinstein/go-graphql-api/graphqlws"
 	"github.com/graphql-go/graphql"
 )
 
@@ -9,14 +11,18 @@ type Root struct {
 	Query        *graphql.Object
 	Mutation     *graphql.Object
 	Subscription *graphql.Object
+	// SubscriptionFields customizes how subscription fields are routed
+	// by the graphqlws.SubscriptionManager.
+	SubscriptionFields map[string]graphqlws.SubscriptionField
 }
 
 // NewRoot initializes the root query, mutation and subscription.
 func NewRoot(resolver *Resolver) *Root {
 	return &Root{
-		Query:        newRootQuery(resolver),
-		Mutation:     newRootMutation(resolver),
-		Subscription: newRootSubscription(resolver),
+		Query:              newRootQuery(resolver),
+		Mutation:           newRootMutation(resolver),
+		Subscription:       newRootSubscription(resolver),
+		SubscriptionFields: newSubscriptionFields(),
 	}
 }
 
@@ -26,8 +32,9 @@ func newRootQuery(resolver *Resolver) *graphql.Object {
 			Name: "Query",
 			Fields: graphql.Fields{
 				"users": &graphql.Field{
-					Type:        graphql.NewList(graphql.NewNonNull(userType)),
-					Description: "Get list of users that match given name",
+					Type:              graphql.NewList(graphql.NewNonNull(userType)),
+					Description:       "Get list of users that match given name",
+					DeprecationReason: "Use usersConnection, which is paginated",
 					Args: graphql.FieldConfigArgument{
 						"name": &graphql.ArgumentConfig{
 							Type:        graphql.String,
@@ -36,14 +43,50 @@ func newRootQuery(resolver *Resolver) *graphql.Object {
 					},
 					Resolve: resolver.Users,
 				},
+				"usersConnection": &graphql.Field{
+					Type:        graphql.NewNonNull(userConnectionType),
+					Description: "Get a page of users",
+					Args: graphql.FieldConfigArgument{
+						"first": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Return the first n users after the `after` cursor",
+						},
+						"after": &graphql.ArgumentConfig{
+							Type:        graphql.String,
+							Description: "Return users after this cursor",
+						},
+						"last": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Return the last n users before the `before` cursor",
+						},
+						"before": &graphql.ArgumentConfig{
+							Type:        graphql.String,
+							Description: "Return users before this cursor",
+						},
+						"filter": &graphql.ArgumentConfig{
+							Type:        userFilterInput,
+							Description: "Filter users",
+						},
+						"orderBy": &graphql.ArgumentConfig{
+							Type:         userOrderEnum,
+							Description:  "Order users",
+							DefaultValue: data.UserOrderIDAsc,
+						},
+					},
+					Resolve: resolver.UsersConnection,
+				},
 				"user": &graphql.Field{
 					Type:        userType,
-					Description: "Get user by email",
+					Description: "Get user by email or id",
 					Args: graphql.FieldConfigArgument{
 						"email": &graphql.ArgumentConfig{
 							Type:        graphql.String,
 							Description: "Filter by email",
 						},
+						"id": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Filter by id",
+						},
 					},
 					Resolve: resolver.User,
 				},
@@ -107,11 +150,114 @@ func newRootSubscription(resolver *Resolver) *graphql.Object {
 					Name:        "userCreated",
 					Description: "Subscribe to userCreated events",
 					Type:        userType,
-					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-						return p.Info.RootValue, nil
+					Args: graphql.FieldConfigArgument{
+						"profession": &graphql.ArgumentConfig{
+							Type:        graphql.String,
+							Description: "Only receive users with this profession",
+						},
+						"minAge": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Only receive users at least this old",
+						},
 					},
+					Resolve: resolveEvent,
+				},
+				"userUpdated": &graphql.Field{
+					Name:        "userUpdated",
+					Description: "Subscribe to userUpdated events",
+					Type:        userUpdatedType,
+					Args: graphql.FieldConfigArgument{
+						"id": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Only receive updates of the user with this id",
+						},
+					},
+					Resolve: resolveEvent,
+				},
+				"userDeleted": &graphql.Field{
+					Name:        "userDeleted",
+					Description: "Subscribe to userDeleted events",
+					Type:        userType,
+					Args: graphql.FieldConfigArgument{
+						"id": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Only receive the deletion of the user with this id",
+						},
+					},
+					Resolve: resolveEvent,
+				},
+				"userChanged": &graphql.Field{
+					Name:        "userChanged",
+					Description: "Subscribe to every event that changes a user",
+					Type:        userChangedType,
+					Args: graphql.FieldConfigArgument{
+						"id": &graphql.ArgumentConfig{
+							Type:        graphql.Int,
+							Description: "Only receive changes of the user with this id",
+						},
+					},
+					Resolve: resolveEvent,
 				},
 			},
 		},
 	)
 }
+
+// resolveEvent resolves a subscription field to the published event.
+func resolveEvent(p graphql.ResolveParams) (interface{}, error) {
+	return p.Info.RootValue, nil
+}
+
+func newSubscriptionFields() map[string]graphqlws.SubscriptionField {
+	return map[string]graphqlws.SubscriptionField{
+		"userCreated": {Filter: filterUserCreated},
+		"userUpdated": {Topic: userTopicFromArgs(TopicUserUpdated)},
+		"userDeleted": {Topic: userTopicFromArgs(TopicUserDeleted)},
+		"userChanged": {Filter: filterUserChanged},
+	}
+}
+
+// filterUserCreated matches the created user against the `profession`
+// and `minAge` arguments.
+func filterUserCreated(payload interface{}, args map[string]interface{}) bool {
+	u, ok := payload.(*data.User)
+	if !ok {
+		return false
+	}
+	if profession, ok := args["profession"].(string); ok && u.Profession != profession {
+		return false
+	}
+	if minAge, ok := args["minAge"].(int); ok && u.Age < minAge {
+		return false
+	}
+	return true
+}
+
+// filterUserChanged matches the changed user against the `id` argument.
+func filterUserChanged(payload interface{}, args map[string]interface{}) bool {
+	id, ok := args["id"].(int)
+	if !ok {
+		return true
+	}
+
+	switch e := payload.(type) {
+	case UserCreatedEvent:
+		return e.User.ID == id
+	case UserUpdatedEvent:
+		return e.After.ID == id
+	case UserDeletedEvent:
+		return e.User.ID == id
+	}
+	return false
+}
+
+// userTopicFromArgs routes subscriptions with an `id` argument to the
+// topic of that user and the others to the topics of every user.
+func userTopicFromArgs(topic string) graphqlws.TopicFunc {
+	return func(args map[string]interface{}) string {
+		if id, ok := args["id"].(int); ok {
+			return userTopic(topic, id)
+		}
+		return anyUserTopic(topic)
+	}
+}
@@ -0,0 +1,111 @@
+package gql
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/dikaeinstein/go-graphql-api/data"
+	"github.com/dikaeinstein/go-graphql-api/dataloader"
+)
+
+type loadersKey struct{}
+
+// LoaderConfig configures the request-scoped loaders.
+type LoaderConfig struct {
+	// Wait is how long lookups are collected before a batch is fetched.
+	Wait time.Duration
+	// MaxBatch is the maximum number of keys fetched in one query.
+	MaxBatch int
+}
+
+// Loaders holds the data loaders of a single request.
+type Loaders struct {
+	UserByEmail *dataloader.Loader
+	UserByID    *dataloader.Loader
+}
+
+// NewLoaders creates the data loaders for a request with the given ctx.
+func NewLoaders(ctx context.Context, store Store, cfg LoaderConfig) *Loaders {
+	l := &Loaders{}
+	l.UserByEmail = dataloader.New(ctx, func(ctx context.Context, keys []interface{}) []dataloader.Result {
+		ctx, cancelFunc := context.WithTimeout(ctx, 3*time.Second)
+		defer cancelFunc()
+
+		emails := make([]string, len(keys))
+		for i, key := range keys {
+			emails[i], _ = key.(string)
+		}
+		users, err := store.GetUsersByEmails(ctx, emails)
+		byEmail := make(map[interface{}]data.User, len(users))
+		for _, u := range users {
+			byEmail[u.Email] = u
+			l.UserByID.Prime(u.ID, userPtr(u))
+		}
+		return userResults(keys, byEmail, err)
+	}, dataloader.Config{Name: "userByEmail", Wait: cfg.Wait, MaxBatch: cfg.MaxBatch})
+
+	l.UserByID = dataloader.New(ctx, func(ctx context.Context, keys []interface{}) []dataloader.Result {
+		ctx, cancelFunc := context.WithTimeout(ctx, 3*time.Second)
+		defer cancelFunc()
+
+		ids := make([]int, len(keys))
+		for i, key := range keys {
+			ids[i], _ = key.(int)
+		}
+		users, err := store.GetUsersByIDs(ctx, ids)
+		byID := make(map[interface{}]data.User, len(users))
+		for _, u := range users {
+			byID[u.ID] = u
+			l.UserByEmail.Prime(u.Email, userPtr(u))
+		}
+		return userResults(keys, byID, err)
+	}, dataloader.Config{Name: "userByID", Wait: cfg.Wait, MaxBatch: cfg.MaxBatch})
+
+	return l
+}
+
+// WithLoaders returns a copy of ctx that carries the given loaders.
+func WithLoaders(ctx context.Context, l *Loaders) context.Context {
+	return context.WithValue(ctx, loadersKey{}, l)
+}
+
+// LoadersFromContext returns the loaders carried by ctx, if any.
+func LoadersFromContext(ctx context.Context) *Loaders {
+	l, _ := ctx.Value(loadersKey{}).(*Loaders)
+	return l
+}
+
+// LoaderMiddleware attaches a fresh set of loaders to every request.
+func LoaderMiddleware(store Store, cfg LoaderConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := WithLoaders(r.Context(), NewLoaders(r.Context(), store, cfg))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// userResults orders the loaded users by key. Keys without a user
+// resolve to sql.ErrNoRows.
+func userResults(keys []interface{}, users map[interface{}]data.User, err error) []dataloader.Result {
+	results := make([]dataloader.Result, len(keys))
+	for i, key := range keys {
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		u, ok := users[key]
+		if !ok {
+			results[i].Err = sql.ErrNoRows
+			continue
+		}
+		results[i].Value = userPtr(u)
+	}
+	return results
+}
+
+func userPtr(u data.User) *data.User {
+	return &u
+}
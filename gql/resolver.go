@@ -7,8 +7,9 @@ import (
 	"time"
 
 	"github.com/dikaeinstein/go-graphql-api/data"
-	"github.com/dikaeinstein/go-graphql-api/graphqlws"
+	"github.com/dikaeinstein/go-graphql-api/logger"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
 	"github.com/mitchellh/mapstructure"
 )
 
@@ -16,20 +17,38 @@ import (
 type Store interface {
 	GetUsersByName(ctx context.Context, name string) ([]data.User, error)
 	GetUserByEmail(ctx context.Context, email string) (*data.User, error)
-	CreateUser(ctx context.Context, userData data.User) (*data.User, error)
-	UpdateUser(context.Context, int, map[string]interface{}) (*data.User, error)
-	DeleteUser(ctx context.Context, id int) (*data.User, error)
+	GetUsersByEmails(ctx context.Context, emails []string) ([]data.User, error)
+	GetUsersByIDs(ctx context.Context, ids []int) ([]data.User, error)
+	GetUsersPage(ctx context.Context, args data.UserPageArgs) (*data.UserPage, error)
+	// CreateUser, UpdateUser and DeleteUser commit the events built from
+	// their result together with the change, for them to be published
+	// once committed.
+	CreateUser(ctx context.Context, userData data.User, events func(data.User) []data.Event) (*data.User, error)
+	UpdateUser(ctx context.Context, id int, payload map[string]interface{},
+		events func(data.UserChange) []data.Event) (*data.UserChange, error)
+	DeleteUser(ctx context.Context, id int, events func(data.User) []data.Event) (*data.User, error)
 }
 
 // Resolver resolves the graphql fields.
 type Resolver struct {
-	store  Store
-	pubsub graphqlws.PubSub
+	store Store
+	log   *logger.Logger
 }
 
-// NewResolver creates a new Resolver.
-func NewResolver(store Store, pubsub graphqlws.PubSub) *Resolver {
-	return &Resolver{store, pubsub}
+// NewResolver creates a new Resolver. log is used for the requests that
+// don't carry a logger in their context.
+func NewResolver(store Store, log *logger.Logger) *Resolver {
+	return &Resolver{store: store, log: log}
+}
+
+// logger returns the logger of the request, tagged with the name of the
+// operation being resolved.
+func (r *Resolver) logger(p graphql.ResolveParams) *logger.Logger {
+	log := logger.FromContext(p.Context, r.log)
+	if op, ok := p.Info.Operation.(*ast.OperationDefinition); ok && op.Name != nil {
+		log = log.With("operation_name", op.Name.Value)
+	}
+	return log
 }
 
 // Users resolves the `users` query.
@@ -45,17 +64,67 @@ func (r *Resolver) Users(p graphql.ResolveParams) (interface{}, error) {
 	return r.store.GetUsersByName(ctx, name)
 }
 
-// User resolves the `user` query.
+// UsersConnection resolves the `usersConnection` query.
+func (r *Resolver) UsersConnection(p graphql.ResolveParams) (interface{}, error) {
+	ctx, cancelFunc := context.WithTimeout(p.Context, 3*time.Second)
+	defer cancelFunc()
+
+	var args data.UserPageArgs
+	if first, ok := p.Args["first"].(int); ok {
+		args.First = &first
+	}
+	if last, ok := p.Args["last"].(int); ok {
+		args.Last = &last
+	}
+	args.After, _ = p.Args["after"].(string)
+	args.Before, _ = p.Args["before"].(string)
+	args.OrderBy, _ = p.Args["orderBy"].(data.UserOrder)
+	if filter, ok := p.Args["filter"]; ok {
+		mapstructure.Decode(filter, &args.Filter)
+	}
+
+	return r.store.GetUsersPage(ctx, args)
+}
+
+// User resolves the `user` query. Lookups are batched and de-duplicated
+// when the request carries loaders.
 func (r *Resolver) User(p graphql.ResolveParams) (interface{}, error) {
+	email, hasEmail := p.Args["email"].(string)
+	id, hasID := p.Args["id"].(int)
+	if hasEmail == hasID {
+		return nil, errors.New("exactly one of email or id must be given")
+	}
+
+	if loaders := LoadersFromContext(p.Context); loaders != nil {
+		var thunk func() (interface{}, error)
+		if hasID {
+			thunk = loaders.UserByID.LoadThunk(id)
+		} else {
+			thunk = loaders.UserByEmail.LoadThunk(email)
+		}
+		return func() (interface{}, error) {
+			return userOrNotFound(thunk())
+		}, nil
+	}
+
 	ctx, cancelFunc := context.WithTimeout(p.Context, 3*time.Second)
 	defer cancelFunc()
 
-	email, ok := p.Args["email"].(string)
-	if !ok {
-		return nil, nil
+	if hasID {
+		users, err := r.store.GetUsersByIDs(ctx, []int{id})
+		if err == nil && len(users) == 0 {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			return userOrNotFound(nil, err)
+		}
+		return &users[0], nil
 	}
+	return userOrNotFound(r.store.GetUserByEmail(ctx, email))
+}
 
-	user, err := r.store.GetUserByEmail(ctx, email)
+// userOrNotFound maps a missing user to a "user not found" error.
+func userOrNotFound(user interface{}, err error) (interface{}, error) {
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.New("user not found")
@@ -78,11 +147,12 @@ func (r *Resolver) CreateUser(p graphql.ResolveParams) (interface{}, error) {
 
 	var u data.User
 	mapstructure.Decode(input, &u)
-	newUser, err := r.store.CreateUser(ctx, u)
+	newUser, err := r.store.CreateUser(ctx, u, userCreatedEvents)
 	if err != nil {
+		r.logger(p).Warn("failed to create user", "error", err)
 		return nil, err
 	}
-	r.pubsub.Publish("userCreated", newUser)
+	r.logger(p).Info("user created", "user_id", newUser.ID)
 	return newUser, nil
 }
 
@@ -97,15 +167,16 @@ func (r *Resolver) UpdateUser(p graphql.ResolveParams) (interface{}, error) {
 		return nil, nil
 	}
 
-	updatedUser, err := r.store.UpdateUser(ctx, id, payload)
+	change, err := r.store.UpdateUser(ctx, id, payload, userUpdatedEvents)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.New("user not found")
 		}
+		r.logger(p).Warn("failed to update user", "user_id", id, "error", err)
 		return nil, err
 	}
-
-	return updatedUser, nil
+	r.logger(p).Info("user updated", "user_id", id, "fields", change.ChangedFields())
+	return &change.After, nil
 }
 
 // DeleteUser resolves the `deleteUser` mutation.
@@ -118,13 +189,14 @@ func (r *Resolver) DeleteUser(p graphql.ResolveParams) (interface{}, error) {
 		return nil, nil
 	}
 
-	deletedUser, err := r.store.DeleteUser(ctx, id)
+	deletedUser, err := r.store.DeleteUser(ctx, id, userDeletedEvents)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errors.New("user not found")
 		}
+		r.logger(p).Warn("failed to delete user", "user_id", id, "error", err)
 		return nil, err
 	}
-
+	r.logger(p).Info("user deleted", "user_id", id)
 	return deletedUser, nil
 }
@@ -1,6 +1,7 @@
 package gql
 
 import (
+	"github.com/dikaeinstein/go-graphql-api/data"
 	"github.com/graphql-go/graphql"
 )
 
@@ -51,3 +52,130 @@ var updateUserInput = graphql.NewInputObject(
 		},
 	},
 )
+
+var userOrderEnum = graphql.NewEnum(
+	graphql.EnumConfig{
+		Name:        "UserOrder",
+		Description: "UserOrder is the order in which users are listed",
+		Values: graphql.EnumValueConfigMap{
+			"ID_ASC":     &graphql.EnumValueConfig{Value: data.UserOrderIDAsc},
+			"ID_DESC":    &graphql.EnumValueConfig{Value: data.UserOrderIDDesc},
+			"NAME_ASC":   &graphql.EnumValueConfig{Value: data.UserOrderNameAsc},
+			"NAME_DESC":  &graphql.EnumValueConfig{Value: data.UserOrderNameDesc},
+			"AGE_ASC":    &graphql.EnumValueConfig{Value: data.UserOrderAgeAsc},
+			"AGE_DESC":   &graphql.EnumValueConfig{Value: data.UserOrderAgeDesc},
+			"EMAIL_ASC":  &graphql.EnumValueConfig{Value: data.UserOrderEmailAsc},
+			"EMAIL_DESC": &graphql.EnumValueConfig{Value: data.UserOrderEmailDesc},
+		},
+	},
+)
+
+var userFilterInput = newUserFilterInput()
+
+func newUserFilterInput() *graphql.InputObject {
+	var filter *graphql.InputObject
+	filter = graphql.NewInputObject(
+		graphql.InputObjectConfig{
+			Name: "UserFilter",
+			Description: "UserFilter narrows down the users returned by a query. " +
+				"A user matches when it satisfies every given field, every filter " +
+				"in `and` and at least one filter in `or`",
+			Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+				return graphql.InputObjectConfigFieldMap{
+					"nameContains": &graphql.InputObjectFieldConfig{
+						Type:        graphql.String,
+						Description: "Users whose name contains the given text, ignoring case",
+					},
+					"nameStartsWith": &graphql.InputObjectFieldConfig{
+						Type:        graphql.String,
+						Description: "Users whose name starts with the given text, ignoring case",
+					},
+					"email": &graphql.InputObjectFieldConfig{
+						Type:        graphql.String,
+						Description: "User with the given email",
+					},
+					"ageMin": &graphql.InputObjectFieldConfig{
+						Type:        graphql.Int,
+						Description: "Users at least this old",
+					},
+					"ageMax": &graphql.InputObjectFieldConfig{
+						Type:        graphql.Int,
+						Description: "Users at most this old",
+					},
+					"professionIn": &graphql.InputObjectFieldConfig{
+						Type:        graphql.NewList(graphql.NewNonNull(graphql.String)),
+						Description: "Users with any of the given professions",
+					},
+					"friendly": &graphql.InputObjectFieldConfig{
+						Type:        graphql.Boolean,
+						Description: "Users that are (or are not) friendly",
+					},
+					"and": &graphql.InputObjectFieldConfig{
+						Type:        graphql.NewList(graphql.NewNonNull(filter)),
+						Description: "Users matching all of the given filters",
+					},
+					"or": &graphql.InputObjectFieldConfig{
+						Type:        graphql.NewList(graphql.NewNonNull(filter)),
+						Description: "Users matching any of the given filters",
+					},
+				}
+			}),
+		},
+	)
+	return filter
+}
+
+var pageInfoType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name:        "PageInfo",
+		Description: "Information about a page of a connection",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean)},
+			"hasPreviousPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean)},
+			"startCursor": &graphql.Field{
+				Type:    graphql.String,
+				Resolve: optionalCursor(func(pi data.PageInfo) string { return pi.StartCursor }),
+			},
+			"endCursor": &graphql.Field{
+				Type:    graphql.String,
+				Resolve: optionalCursor(func(pi data.PageInfo) string { return pi.EndCursor }),
+			},
+		},
+	},
+)
+
+var userEdgeType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name:        "UserEdge",
+		Description: "A user in a connection",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(userType)},
+		},
+	},
+)
+
+var userConnectionType = graphql.NewObject(
+	graphql.ObjectConfig{
+		Name:        "UserConnection",
+		Description: "A page of users",
+		Fields: graphql.Fields{
+			"edges": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userEdgeType)))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+		},
+	},
+)
+
+// optionalCursor resolves an empty cursor to null.
+func optionalCursor(cursor func(data.PageInfo) string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		pi, ok := p.Source.(data.PageInfo)
+		if !ok || cursor(pi) == "" {
+			return nil, nil
+		}
+		return cursor(pi), nil
+	}
+}
@@ -1,9 +1,24 @@
 package graphqlws
 
 import (
+	"context"
+
 	"github.com/gorilla/websocket"
 )
 
+// Supported WebSocket subprotocols.
+const (
+	// protocolGraphQLWS is the legacy subscriptions-transport-ws protocol.
+	protocolGraphQLWS = "graphql-ws"
+	// protocolGraphQLTransportWS is the graphql-ws library protocol.
+	protocolGraphQLTransportWS = "graphql-transport-ws"
+)
+
+// Subprotocols lists the supported WebSocket subprotocols in order of
+// preference. Connections that don't negotiate a subprotocol speak the
+// legacy graphql-ws protocol.
+var Subprotocols = []string{protocolGraphQLTransportWS, protocolGraphQLWS}
+
 const (
 	// Constants for operation message types
 	gqlConnectionInit      = "connection_init"
@@ -16,12 +31,34 @@ const (
 	gqlError               = "error"
 	gqlComplete            = "complete"
 	gqlStop                = "stop"
+
+	// Message types only used by graphql-transport-ws
+	gqlSubscribe = "subscribe"
+	gqlNext      = "next"
+	gqlPing      = "ping"
+	gqlPong      = "pong"
+)
+
+// Close codes used by graphql-transport-ws.
+const (
+	closeBadRequest          = 4400
+	closeUnauthorized        = 4401
+	closeForbidden           = 4403
+	closeInitTimeout         = 4408
+	closeSubscriberExists    = 4409
+	closeTooManyInitRequests = 4429
 )
 
 // ConnectionEventHandlers define the event handlers for a connection.
 // Event handlers allow other system components to react to events such
 // as the connection closing or an operation being started or stopped.
 type ConnectionEventHandlers struct {
+	// OnConnect is called with the payload of the client's connection_init
+	// message, typically to authenticate the client. The returned context
+	// is used to execute every operation of the connection. Returning an
+	// error rejects the connection. A nil OnConnect accepts every client.
+	OnConnect func(ctx context.Context, payload map[string]interface{}) (context.Context, error)
+
 	// Close is called whenever the connection is closed, regardless of
 	// whether this happens because of an error or a deliberate termination
 	// by the client.
@@ -31,11 +68,13 @@ type ConnectionEventHandlers struct {
 	// operation be started (typically a subscription). Event handlers
 	// are expected to take the necessary steps to register the operation
 	// and send data back to the client with the results eventually.
-	Start func(s *Subscription)
+	// A returned error is sent to the client and ends the operation;
+	// return an *OperationError to control the errors sent.
+	Start func(s *Subscription) error
 
 	// Stop handler is called whenever the client stops a previously
 	// started GraphQL operation (typically a subscription). Event handlers
 	// are expected to unregister the operation and stop sending result
 	// data to the client.
-	Stop func(subID string)
+	Stop func(conn *websocket.Conn, subID string)
 }
@@ -0,0 +1,105 @@
+package graphqlws
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/pkg/errors"
+)
+
+// parseOperation parses and validates the request against the schema and
+// returns the document together with the operation to execute. Parse and
+// validation failures are returned as an *OperationError.
+func parseOperation(schema *graphql.Schema, requestString, operationName string) (*ast.Document, *ast.OperationDefinition, error) {
+	source := source.NewSource(&source.Source{
+		Body: []byte(requestString),
+		Name: "GraphQL request",
+	})
+	document, err := parser.Parse(parser.ParseParams{Source: source})
+	if err != nil {
+		return nil, nil, &OperationError{Errors: gqlerrors.FormatErrors(err)}
+	}
+	validation := graphql.ValidateDocument(schema, document, graphql.SpecifiedRules)
+	if !validation.IsValid {
+		return nil, nil, &OperationError{Errors: validation.Errors}
+	}
+
+	operation, err := getOperation(document, operationName)
+	if err != nil {
+		return nil, nil, &OperationError{Errors: gqlerrors.FormatErrors(err)}
+	}
+	return document, operation, nil
+}
+
+// getOperation returns the operation named operationName from the document.
+// The name may be empty when the document contains a single operation.
+func getOperation(document *ast.Document, operationName string) (*ast.OperationDefinition, error) {
+	var operation *ast.OperationDefinition
+	for _, node := range document.Definitions {
+		def, ok := node.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" {
+			if operation != nil {
+				return nil, errors.New("must provide operation name if query contains multiple operations")
+			}
+			operation = def
+			continue
+		}
+		if def.Name != nil && def.Name.Value == operationName {
+			operation = def
+		}
+	}
+
+	if operation == nil {
+		if operationName != "" {
+			return nil, fmt.Errorf("unknown operation named %q", operationName)
+		}
+		return nil, errors.New("must provide an operation")
+	}
+	return operation, nil
+}
+
+// rootFields returns the fields selected at the root of the operation,
+// expanding fragment spreads and inline fragments.
+func rootFields(document *ast.Document, operation *ast.OperationDefinition) []*ast.Field {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, node := range document.Definitions {
+		if def, ok := node.(*ast.FragmentDefinition); ok && def.Name != nil {
+			fragments[def.Name.Value] = def
+		}
+	}
+
+	var fields []*ast.Field
+	visited := make(map[string]bool)
+	var collect func(set *ast.SelectionSet)
+	collect = func(set *ast.SelectionSet) {
+		if set == nil {
+			return
+		}
+		for _, selection := range set.Selections {
+			switch sel := selection.(type) {
+			case *ast.Field:
+				fields = append(fields, sel)
+			case *ast.InlineFragment:
+				collect(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				if sel.Name == nil || visited[sel.Name.Value] {
+					continue
+				}
+				visited[sel.Name.Value] = true
+				if fragment, ok := fragments[sel.Name.Value]; ok {
+					collect(fragment.SelectionSet)
+				}
+			}
+		}
+	}
+	collect(operation.GetSelectionSet())
+
+	return fields
+}
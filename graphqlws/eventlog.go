@@ -0,0 +1,130 @@
+package graphqlws
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResumeUnavailable is returned when a subscription cannot resume
+// because the events after its last event ID are no longer logged.
+var ErrResumeUnavailable = errors.New("cannot resume: events after the last event ID are no longer available")
+
+// LoggedEvent is a payload published together with its ID in an event
+// log. Subscriptions send the ID in the extensions of their results, as
+// eventId, for clients to resume after it.
+type LoggedEvent struct {
+	ID      int64
+	Payload interface{}
+}
+
+// EventLog replays the logged events to the subscriptions resuming after
+// a last event ID.
+type EventLog interface {
+	// EventsAfter returns the events published on the topic after the
+	// event with the given ID, oldest first. The topic may contain
+	// wildcards, like the topics passed to PubSub.Subscribe.
+	EventsAfter(ctx context.Context, topic string, id int64) ([]LoggedEvent, error)
+}
+
+// resumer holds back the live events of a resuming subscription while the
+// logged events are replayed, then delivers them, skipping the ones that
+// were replayed. The live events keep being queued during the replay, so
+// the pubsub is never blocked by it.
+type resumer struct {
+	mu       sync.Mutex
+	live     bool
+	replayed map[int64]bool
+	pending  []interface{}
+	deliver  Handler
+}
+
+func newResumer(deliver Handler) *resumer {
+	return &resumer{deliver: deliver}
+}
+
+// handle is the pubsub handler of the subscription.
+func (r *resumer) handle(payload interface{}) error {
+	r.mu.Lock()
+	if !r.live {
+		r.pending = append(r.pending, payload)
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+	return r.deliverLive(payload)
+}
+
+// finish replays events with replay, then delivers the live events held
+// back meanwhile, until none is left and the live events are delivered as
+// they come. It stops with ctx.Err() once ctx is done.
+func (r *resumer) finish(ctx context.Context, events []LoggedEvent, replay Handler) error {
+	replayed := make(map[int64]bool, len(events))
+	for _, e := range events {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := replay(e); err != nil {
+			return err
+		}
+		replayed[e.ID] = true
+	}
+
+	r.mu.Lock()
+	r.replayed = replayed
+	r.mu.Unlock()
+	for {
+		r.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		if len(pending) == 0 {
+			r.live = true
+			r.mu.Unlock()
+			return nil
+		}
+		r.mu.Unlock()
+
+		for _, payload := range pending {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := r.deliverLive(payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// deliverLive delivers a live event unless it was replayed. replayed is
+// not modified once the live events are delivered.
+func (r *resumer) deliverLive(payload interface{}) error {
+	if e, ok := payload.(LoggedEvent); ok && r.replayed[e.ID] {
+		return nil
+	}
+	return r.deliver(payload)
+}
+
+// parseEventID parses the lastEventId sent by a client, either a JSON
+// number or a string.
+func parseEventID(v interface{}) (int64, error) {
+	switch id := v.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if id < 0 || id != math.Trunc(id) || id > math.MaxInt64 {
+			return 0, fmt.Errorf("invalid lastEventId %v", id)
+		}
+		return int64(id), nil
+	case string:
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid lastEventId %q", id)
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("invalid lastEventId %v", v)
+}
@@ -1,111 +1,747 @@
 package graphqlws
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dikaeinstein/go-graphql-api/logger"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
 	"github.com/pkg/errors"
 )
 
+// Time allowed to write a control message to the peer.
+const writeWait = time.Second
+
 // ConnectionMessage represents the GraphQL WebSocket message.
 type ConnectionMessage struct {
-	OperationID string `json:"id,omitempty"`
-	Type        string `json:"type"`
-	Payload     struct {
-		OperationName string                 `json:"operationName,omitempty"`
-		Query         string                 `json:"query"`
-		Variables     map[string]interface{} `json:"variables"`
-	} `json:"payload,omitempty"`
+	OperationID string          `json:"id,omitempty"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+// OperationPayload is the payload of the messages that start an operation.
+type OperationPayload struct {
+	OperationName string                 `json:"operationName,omitempty"`
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	// Extensions may hold the lastEventId a subscription resumes after,
+	// overriding the one sent with connection_init.
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
 }
 
 type graphqlWS struct {
 	eventHandlers       ConnectionEventHandlers
 	upgrader            websocket.Upgrader
 	subscriptionManager *SubscriptionManager
+	initTimeout         time.Duration
+	keepAlive           time.Duration
+	idleTimeout         time.Duration
+	sendQueueSize       int
+	overflow            OverflowPolicy
+	writeTimeout        time.Duration
+	closeGracePeriod    time.Duration
+	resumeWindow        time.Duration
+	rate                float64
+	burst               int
+	log                 *logger.Logger
 }
 
+// Option configures the websocket handler.
+type Option func(*graphqlWS)
+
 // NewHandler returns a websocket based HTTP handler for graphQL.
-func NewHandler(u websocket.Upgrader, s *SubscriptionManager, e ConnectionEventHandlers) http.Handler {
-	return &graphqlWS{
+// The upgrader offers the supported Subprotocols unless it is configured
+// with its own.
+func NewHandler(u websocket.Upgrader, s *SubscriptionManager, e ConnectionEventHandlers,
+	options ...Option) http.Handler {
+	if len(u.Subprotocols) == 0 {
+		u.Subprotocols = Subprotocols
+	}
+
+	gws := &graphqlWS{
 		eventHandlers:       e,
 		upgrader:            u,
 		subscriptionManager: s,
+		initTimeout:         10 * time.Second,
+		keepAlive:           10 * time.Second,
+		idleTimeout:         30 * time.Second,
+		sendQueueSize:       64,
+		overflow:            DisconnectSlowConsumer,
+		writeTimeout:        10 * time.Second,
+		closeGracePeriod:    5 * time.Second,
+		resumeWindow:        10 * time.Second,
+		log:                 logger.Default(),
+	}
+	for _, option := range options {
+		option(gws)
+	}
+
+	return gws
+}
+
+// ConnectionInitTimeout option sets how long a client has to send
+// connection_init before the connection is closed.
+func ConnectionInitTimeout(timeout time.Duration) Option {
+	return func(gws *graphqlWS) {
+		gws.initTimeout = timeout
+	}
+}
+
+// KeepAlive option sets how often the server pings the client. Legacy
+// graphql-ws clients also receive a `ka` message. Zero disables keep-alive.
+func KeepAlive(interval time.Duration) Option {
+	return func(gws *graphqlWS) {
+		gws.keepAlive = interval
+	}
+}
+
+// IdleTimeout option sets how long a connection may go without receiving
+// a message or pong from the client before it is closed and all of its
+// subscriptions are removed. Zero disables the timeout. It should be
+// longer than the keep-alive interval.
+func IdleTimeout(timeout time.Duration) Option {
+	return func(gws *graphqlWS) {
+		gws.idleTimeout = timeout
+	}
+}
+
+// SendQueue option sets the number of outbound messages buffered per
+// connection and what happens to messages sent while the buffer is full.
+func SendQueue(size int, overflow OverflowPolicy) Option {
+	return func(gws *graphqlWS) {
+		gws.sendQueueSize = size
+		gws.overflow = overflow
+	}
+}
+
+// WriteTimeout option sets how long writing a message to a client may
+// take before the connection is considered dead. Zero means no timeout.
+func WriteTimeout(timeout time.Duration) Option {
+	return func(gws *graphqlWS) {
+		gws.writeTimeout = timeout
+	}
+}
+
+// CloseGracePeriod option sets how long the server waits for a client to
+// answer a close frame before the connection is dropped.
+func CloseGracePeriod(timeout time.Duration) Option {
+	return func(gws *graphqlWS) {
+		gws.closeGracePeriod = timeout
+	}
+}
+
+// ResumeWindow option sets how long after connection_ack the lastEventId
+// sent with connection_init applies. Within the window, the first
+// subscription started with each operation ID resumes after it; later
+// subscriptions start with the events published from then on unless they
+// send their own lastEventId.
+func ResumeWindow(window time.Duration) Option {
+	return func(gws *graphqlWS) {
+		gws.resumeWindow = window
+	}
+}
+
+// RateLimit option limits the messages read from each connection to rate
+// per second, allowing bursts of up to burst messages. Reading is paused
+// while a client is over its limit. A zero rate disables the limit.
+func RateLimit(rate float64, burst int) Option {
+	return func(gws *graphqlWS) {
+		gws.rate = rate
+		gws.burst = burst
+	}
+}
+
+// Logger option sets the logger of the handler. Requests carrying a
+// logger in their context use that one instead.
+func Logger(l *logger.Logger) Option {
+	return func(gws *graphqlWS) {
+		gws.log = l
 	}
 }
 
 func (gws *graphqlWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logger.FromContext(r.Context(), gws.log)
 	conn, err := gws.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("failed to do websocket upgrade: %v", err)
+		log.Warn("failed to do websocket upgrade", "error", err)
 		return
 	}
 	defer conn.Close()
 
-	connectionACK := map[string]string{
-		"type": gqlConnectionAck,
+	protocol := conn.Subprotocol()
+	if protocol == "" {
+		protocol = protocolGraphQLWS
 	}
-	if err := conn.WriteJSON(connectionACK); err != nil {
-		log.Printf("failed to write to ws connection: %v", err)
-		return
+	log = log.With("connection_id", uuid.New().String(), "protocol", protocol)
+	log.Debug("connection opened")
+
+	c := &connection{
+		ctx:        logger.NewContext(r.Context(), log),
+		ws:         conn,
+		protocol:   protocol,
+		handler:    gws,
+		log:        log,
+		sendQueue:  make(chan outbound, gws.sendQueueSize),
+		done:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+		operations: make(map[string]bool),
+		resumed:    make(map[string]bool),
+	}
+	c.opsCond = sync.NewCond(&c.opsMu)
+	if gws.rate > 0 {
+		c.limiter = newRateLimiter(gws.rate, gws.burst)
 	}
-	handleWSConn(conn, gws.subscriptionManager, gws.eventHandlers)
+	go c.writePump()
+	defer func() {
+		c.opsMu.Lock()
+		c.finished = true
+		c.opsCond.Broadcast()
+		c.opsMu.Unlock()
+
+		close(c.done)
+		<-c.writerDone
+	}()
+	if !gws.subscriptionManager.addConnection(conn, c.shutdown) {
+		c.closeWithCode(websocket.CloseGoingAway, "Server shutting down")
+	}
+	c.serve()
+}
+
+// connection is a client connection speaking one of the Subprotocols.
+type connection struct {
+	// ctx is the context operations are executed with. It is replaced by
+	// the context returned from OnConnect.
+	ctx      context.Context
+	ws       *websocket.Conn
+	protocol string
+	handler  *graphqlWS
+	log      *logger.Logger
+	// sendQueue feeds the writer goroutine, which stops when done is
+	// closed and closes writerDone when it exits.
+	sendQueue  chan outbound
+	done       chan struct{}
+	writerDone chan struct{}
+	// closing is set once the connection is being closed.
+	closing int32
+	// acked is set once connection_ack has been sent.
+	acked int32
+	// initReceived, limiter and the resume fields are only used by the
+	// read loop.
+	initReceived bool
+	limiter      *rateLimiter
+	// lastEventID is the lastEventId sent with connection_init, after
+	// which the subscriptions started until resumeUntil resume. resumed
+	// holds the operation IDs that used it.
+	lastEventID int64
+	resumeUntil time.Time
+	resumed     map[string]bool
+	// operations tracks the IDs of the running operations. opsCond is
+	// signalled when an operation ends or the connection is finished.
+	opsMu      sync.Mutex
+	opsCond    *sync.Cond
+	operations map[string]bool
+	finished   bool
 }
 
-func handleWSConn(conn *websocket.Conn, subMgr *SubscriptionManager, e ConnectionEventHandlers) {
+func (c *connection) serve() {
+	timer := time.AfterFunc(c.handler.initTimeout, func() {
+		if atomic.LoadInt32(&c.acked) == 0 {
+			c.reject(closeInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer timer.Stop()
+	defer c.handler.subscriptionManager.RemoveConnection(c.ws)
+
+	if c.handler.keepAlive > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go c.keepAlive(done)
+	}
+	c.ws.SetPongHandler(func(string) error {
+		c.extendReadDeadline()
+		return nil
+	})
+
 	for {
+		c.extendReadDeadline()
 		var msg ConnectionMessage
-		err := conn.ReadJSON(&msg)
-		if websocket.IsCloseError(err, websocket.CloseGoingAway) {
-			log.Println("connection closed; going away")
+		err := c.ws.ReadJSON(&msg)
+		if err != nil && atomic.LoadInt32(&c.closing) == 1 {
+			c.log.Debug("connection closed")
+			return
+		}
+		if websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+			c.log.Debug("connection closed by client")
+			return
+		}
+		if isJSONError(err) && c.protocol == protocolGraphQLTransportWS {
+			c.closeWithCode(closeBadRequest, "Invalid message received")
+			continue
+		}
+		if isTimeout(err) {
+			c.log.Info("connection closed; idle timeout")
 			return
 		}
 		if err != nil {
-			log.Println("failed to read websocket message:", err)
+			c.log.Warn("failed to read websocket message", "error", err)
+			return
+		}
+		if atomic.LoadInt32(&c.closing) == 1 {
+			// the close frame was sent; discard messages until the client
+			// answers it or the close grace period expires
+			continue
+		}
+
+		var ok bool
+		if c.protocol == protocolGraphQLTransportWS {
+			ok = c.handleTransportMessage(msg)
+		} else {
+			ok = c.handleLegacyMessage(msg)
+		}
+		if !ok && atomic.LoadInt32(&c.closing) == 0 {
+			return
+		}
+		if !c.throttle() {
+			return
+		}
+	}
+}
+
+// throttle waits until the client may send another message. It returns
+// false when the request is cancelled while waiting.
+func (c *connection) throttle() bool {
+	if c.limiter == nil {
+		return true
+	}
+	delay := c.limiter.reserve(time.Now())
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// handleLegacyMessage handles a graphql-ws message. It returns false when
+// the connection should be closed.
+func (c *connection) handleLegacyMessage(msg ConnectionMessage) bool {
+	e := c.handler.eventHandlers
+	switch msg.Type {
+	case gqlConnectionInit:
+		if c.initReceived {
+			return true
+		}
+		c.initReceived = true
+		return c.init(msg.Payload)
+	case gqlStart:
+		if atomic.LoadInt32(&c.acked) == 0 {
+			c.reject(closeUnauthorized, "Unauthorized")
+			return false
+		}
+		var payload OperationPayload
+		if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+			c.sendError(msg.OperationID, errors.New("invalid start payload"))
+			return true
+		}
+		if !c.addOperation(msg.OperationID) {
+			c.sendError(msg.OperationID,
+				fmt.Errorf("operation %s already exists", msg.OperationID))
+			return true
+		}
+		c.startOperation(msg.OperationID, payload)
+	case gqlStop:
+		if c.endOperation(msg.OperationID) {
+			e.Stop(c.ws, msg.OperationID)
+		}
+	case gqlConnectionTerminate:
+		c.closeWithCode(websocket.CloseNormalClosure, "")
+		e.Close(c.ws)
+		return false
+	default:
+		c.log.Warn("unhandled message", "type", msg.Type)
+	}
+	return true
+}
+
+// handleTransportMessage handles a graphql-transport-ws message. It returns
+// false when the connection should be closed.
+func (c *connection) handleTransportMessage(msg ConnectionMessage) bool {
+	e := c.handler.eventHandlers
+	switch msg.Type {
+	case gqlConnectionInit:
+		if c.initReceived {
+			c.closeWithCode(closeTooManyInitRequests, "Too many initialisation requests")
+			return false
+		}
+		c.initReceived = true
+		return c.init(msg.Payload)
+	case gqlPing:
+		pong := map[string]interface{}{"type": gqlPong}
+		if len(msg.Payload) > 0 {
+			pong["payload"] = msg.Payload
+		}
+		if err := c.send(pong); err != nil {
+			c.log.Warn("failed to write to ws connection", "error", err)
+			return false
+		}
+	case gqlPong:
+	case gqlSubscribe:
+		if atomic.LoadInt32(&c.acked) == 0 {
+			c.closeWithCode(closeUnauthorized, "Unauthorized")
+			return false
+		}
+		var payload OperationPayload
+		if msg.OperationID == "" || json.Unmarshal(msg.Payload, &payload) != nil {
+			c.closeWithCode(closeBadRequest, "Invalid message received")
+			return false
+		}
+		if !c.addOperation(msg.OperationID) {
+			c.closeWithCode(closeSubscriberExists,
+				fmt.Sprintf("Subscriber for %s already exists", msg.OperationID))
+			return false
+		}
+		c.startOperation(msg.OperationID, payload)
+	case gqlComplete:
+		if c.endOperation(msg.OperationID) {
+			e.Stop(c.ws, msg.OperationID)
+		}
+	default:
+		c.closeWithCode(closeBadRequest, "Invalid message received")
+		return false
+	}
+	return true
+}
+
+// addOperation records a new running operation. It returns false when an
+// operation with the same ID is already running.
+func (c *connection) addOperation(id string) bool {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+
+	if c.operations[id] {
+		return false
+	}
+	c.operations[id] = true
+	return true
+}
+
+// endOperation forgets a running operation. It returns false when the
+// operation was not running.
+func (c *connection) endOperation(id string) bool {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+
+	if !c.operations[id] {
+		return false
+	}
+	delete(c.operations, id)
+	c.opsCond.Broadcast()
+	return true
+}
+
+// isOperation reports whether the operation is running.
+func (c *connection) isOperation(id string) bool {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+	return c.operations[id]
+}
+
+// startOperation starts an operation, reporting failures to the client.
+// Subscriptions are handed to the Start event handler while queries and
+// mutations are executed once.
+func (c *connection) startOperation(id string, payload OperationPayload) {
+	schema := c.handler.subscriptionManager.Schema
+	document, operation, err := parseOperation(schema, payload.Query, payload.OperationName)
+	if err != nil {
+		c.endOperation(id)
+		c.sendError(id, err)
+		return
+	}
+
+	log := c.log.With("operation_id", id, "operation_name", payload.OperationName)
+	ctx := logger.NewContext(c.ctx, log)
+	if operation.Operation != ast.OperationTypeSubscription {
+		go c.executeOperation(ctx, id, document, payload)
+		return
+	}
+
+	lastEventID := c.connectionLastEventID(id)
+	if v, ok := payload.Extensions["lastEventId"]; ok {
+		if lastEventID, err = parseEventID(v); err != nil {
+			c.endOperation(id)
+			c.sendError(id, err)
 			return
 		}
+	}
+
+	err = c.handler.eventHandlers.Start(c.createSubscription(ctx, id, payload, lastEventID))
+	if err != nil {
+		log.Info("failed to start subscription", "error", err)
+		c.endOperation(id)
+		c.sendError(id, err)
+	}
+}
+
+// connectionLastEventID returns the lastEventId sent with connection_init
+// if the operation is the first started with its ID within the resume
+// window, and zero otherwise, so that the ID is not reused once the
+// client has caught up.
+func (c *connection) connectionLastEventID(id string) int64 {
+	if c.lastEventID == 0 || c.resumed[id] || time.Now().After(c.resumeUntil) {
+		return 0
+	}
+	c.resumed[id] = true
+	return c.lastEventID
+}
+
+// executeOperation executes a query or mutation and sends its result
+// followed by complete, unless the client stopped the operation meanwhile.
+func (c *connection) executeOperation(ctx context.Context, id string, document *ast.Document,
+	payload OperationPayload) {
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        *c.handler.subscriptionManager.Schema,
+		AST:           document,
+		OperationName: payload.OperationName,
+		Args:          payload.Variables,
+		Context:       ctx,
+	})
+	if !c.isOperation(id) {
+		return
+	}
+
+	m := map[string]interface{}{
+		"id":      id,
+		"type":    c.dataMessageType(),
+		"payload": result,
+	}
+	if err := c.send(m); err != nil {
+		c.log.Warn("failed to write to ws connection", "operation_id", id, "error", err)
+	}
+	c.sendComplete(id)
+}
+
+// sendError tells the client that the operation failed. The operation is
+// over once the error is sent.
+func (c *connection) sendError(id string, err error) {
+	var opErr *OperationError
+	if !errors.As(err, &opErr) {
+		opErr = &OperationError{Errors: gqlerrors.FormatErrors(err)}
+	}
 
-		switch msg.Type {
-		case gqlStart:
-			s := createSubscription(conn, msg, subMgr)
-			e.Start(s)
-		case gqlStop:
-			e.Stop(msg.OperationID)
-		case gqlConnectionTerminate:
-			e.Close(conn)
-		default:
-			log.Println("unhandled message", msg.Type)
+	m := map[string]interface{}{
+		"id":      id,
+		"type":    gqlError,
+		"payload": opErr.Errors,
+	}
+	if err := c.send(m); err != nil {
+		c.log.Warn("failed to write to ws connection", "operation_id", id, "error", err)
+	}
+}
+
+// sendComplete tells the client that the server ended the operation.
+func (c *connection) sendComplete(id string) {
+	if !c.endOperation(id) {
+		return
+	}
+
+	m := map[string]interface{}{
+		"id":   id,
+		"type": gqlComplete,
+	}
+	if err := c.send(m); err != nil {
+		c.log.Warn("failed to write to ws connection", "operation_id", id, "error", err)
+	}
+}
+
+// init runs the OnConnect hook with the connection_init payload and
+// acknowledges the connection when it is accepted. It returns false when
+// the connection was rejected.
+func (c *connection) init(rawPayload json.RawMessage) bool {
+	var payload map[string]interface{}
+	if len(rawPayload) > 0 {
+		if err := json.Unmarshal(rawPayload, &payload); err != nil {
+			c.reject(closeBadRequest, "Invalid connection_init payload")
+			return false
 		}
-		time.Sleep(1000 * time.Millisecond)
 	}
+
+	lastEventID, err := parseEventID(payload["lastEventId"])
+	if err != nil {
+		c.reject(closeBadRequest, err.Error())
+		return false
+	}
+	c.lastEventID = lastEventID
+
+	if onConnect := c.handler.eventHandlers.OnConnect; onConnect != nil {
+		ctx, err := onConnect(c.ctx, payload)
+		if err != nil {
+			c.log.Info("connection rejected", "error", err)
+			c.reject(closeForbidden, err.Error())
+			return false
+		}
+		if ctx != nil {
+			c.ctx = ctx
+		}
+	}
+
+	connectionACK := map[string]string{
+		"type": gqlConnectionAck,
+	}
+	if err := c.send(connectionACK); err != nil {
+		c.log.Warn("failed to write to ws connection", "error", err)
+		return false
+	}
+	atomic.StoreInt32(&c.acked, 1)
+	c.resumeUntil = time.Now().Add(c.handler.resumeWindow)
+	return true
 }
 
-func createSubscription(conn *websocket.Conn, msg ConnectionMessage, subMgr *SubscriptionManager) *Subscription {
-	callback := func(result *graphql.Result) error {
-		m := map[string]interface{}{
-			"id":      msg.OperationID,
-			"type":    gqlData,
-			"payload": result,
+// reject closes the connection before it was acknowledged. Legacy clients
+// receive a connection_error message, graphql-transport-ws clients receive
+// the given close code.
+func (c *connection) reject(code int, reason string) {
+	if c.protocol == protocolGraphQLTransportWS {
+		c.closeWithCode(code, reason)
+		return
+	}
+
+	connectionError := map[string]interface{}{
+		"type":    gqlConnectionError,
+		"payload": map[string]string{"message": reason},
+	}
+	if err := c.send(connectionError); err != nil {
+		c.log.Warn("failed to write to ws connection", "error", err)
+	}
+	c.closeWithCode(websocket.CloseNormalClosure, "")
+}
+
+// shutdown closes the connection with the going away close code once its
+// running operations have ended. It does not block.
+func (c *connection) shutdown() {
+	go func() {
+		c.opsMu.Lock()
+		for len(c.operations) > 0 && !c.finished {
+			c.opsCond.Wait()
 		}
-		if err := conn.WriteJSON(m); err != nil {
-			if err == websocket.ErrCloseSent {
-				subMgr.RemoveSubscription(msg.OperationID)
-				log.Println("subscription removed")
+		finished := c.finished
+		c.opsMu.Unlock()
+
+		if finished {
+			return
+		}
+		c.closeWithCode(websocket.CloseGoingAway, "Server shutting down")
+	}()
+}
+
+// keepAlive pings the client until done is closed.
+func (c *connection) keepAlive(done <-chan struct{}) {
+	ticker := time.NewTicker(c.handler.keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			if err != nil {
+				return
+			}
+			if c.protocol == protocolGraphQLWS && atomic.LoadInt32(&c.acked) == 1 {
+				ka := map[string]string{"type": gqlConnectionKeepAlive}
+				if err := c.send(ka); err != nil {
+					return
+				}
 			}
-			return errors.Wrap(err, "failed to write to ws connection")
 		}
+	}
+}
 
-		return nil
+// extendReadDeadline gives the client another idle timeout to send a
+// message or pong.
+func (c *connection) extendReadDeadline() {
+	if c.handler.idleTimeout > 0 && atomic.LoadInt32(&c.closing) == 0 {
+		c.ws.SetReadDeadline(time.Now().Add(c.handler.idleTimeout))
+	}
+}
+
+// dataMessageType returns the type of the messages carrying results.
+func (c *connection) dataMessageType() string {
+	if c.protocol == protocolGraphQLTransportWS {
+		return gqlNext
+	}
+	return gqlData
+}
+
+func (c *connection) createSubscription(ctx context.Context, id string,
+	payload OperationPayload, lastEventID int64) *Subscription {
+	subMgr := c.handler.subscriptionManager
+	callback := func(send func(interface{}) error) CallBack {
+		return func(result *graphql.Result) error {
+			m := map[string]interface{}{
+				"id":      id,
+				"type":    c.dataMessageType(),
+				"payload": result,
+			}
+			if err := send(m); err != nil {
+				if err == ErrConnectionClosed {
+					subMgr.RemoveSubscription(c.ws, id)
+					c.log.Debug("subscription removed", "operation_id", id)
+				}
+				return errors.Wrap(err, "failed to write to ws connection")
+			}
+
+			return nil
+		}
 	}
 
 	return &Subscription{
-		ID:            msg.OperationID,
-		RequestString: msg.Payload.Query,
-		Variables:     msg.Payload.Variables,
-		OperationName: msg.Payload.OperationName,
-		Conn:          conn,
-		CallBack:      callback,
+		ID:            id,
+		RequestString: payload.Query,
+		Variables:     payload.Variables,
+		OperationName: payload.OperationName,
+		Context:       ctx,
+		Conn:          c.ws,
+		CallBack:      callback(c.send),
+		// a replay sends many results at once, so it waits for the
+		// client instead of overflowing the send queue
+		ReplayCallBack: callback(func(m interface{}) error { return c.sendWait(ctx, m) }),
+		LastEventID:    lastEventID,
+		OnComplete:     func() { c.sendComplete(id) },
+		OnError: func(err error) {
+			logger.FromContext(ctx, c.log).Info("failed to resume subscription", "error", err)
+			if c.endOperation(id) {
+				c.sendError(id, err)
+			}
+		},
 	}
 }
+
+// isTimeout reports whether err is caused by an expired deadline.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isJSONError reports whether err is caused by a malformed message.
+func isJSONError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
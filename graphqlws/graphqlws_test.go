@@ -0,0 +1,362 @@
+package graphqlws
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dikaeinstein/go-graphql-api/logger"
+	"github.com/gorilla/websocket"
+)
+
+// testLogger discards the logs of the handler under test.
+var testLogger = logger.New(ioutil.Discard, logger.ErrorLevel, logger.TextFormat)
+
+// testServer serves a handler backed by a fakePubSub.
+type testServer struct {
+	*httptest.Server
+	sm *SubscriptionManager
+	ps *fakePubSub
+}
+
+// newTestServer starts a server whose Start and Stop handlers add and
+// remove subscriptions, unless handlers sets its own.
+func newTestServer(t *testing.T, handlers ConnectionEventHandlers, options ...Option) *testServer {
+	t.Helper()
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+	if handlers.Start == nil {
+		handlers.Start = sm.AddSubscription
+	}
+	if handlers.Stop == nil {
+		handlers.Stop = sm.RemoveSubscription
+	}
+	if handlers.Close == nil {
+		handlers.Close = func(*websocket.Conn) {}
+	}
+
+	options = append([]Option{Logger(testLogger)}, options...)
+	h := NewHandler(websocket.Upgrader{}, sm, handlers, options...)
+	return &testServer{Server: httptest.NewServer(h), sm: sm, ps: ps}
+}
+
+func wsURL(httpURL string) string {
+	return "ws" + strings.TrimPrefix(httpURL, "http")
+}
+
+// dial opens a client connection speaking protocol, or no subprotocol
+// when it is empty.
+func dial(t *testing.T, url, protocol string) *websocket.Conn {
+	t.Helper()
+	dialer := websocket.Dialer{}
+	if protocol != "" {
+		dialer.Subprotocols = []string{protocol}
+	}
+	ws, _, err := dialer.Dial(wsURL(url), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	return ws
+}
+
+func writeMessage(t *testing.T, ws *websocket.Conn, msg interface{}) {
+	t.Helper()
+	if err := ws.WriteJSON(msg); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+}
+
+// readMessage reads the next message, failing the test after a second.
+func readMessage(t *testing.T, ws *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var msg map[string]interface{}
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON() error = %v", err)
+	}
+	return msg
+}
+
+// readClose reads until the connection is closed and returns the close
+// code sent by the server.
+func readClose(t *testing.T, ws *websocket.Conn) int {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			t.Fatalf("ReadMessage() error = %v, want a close frame", err)
+		}
+		return closeErr.Code
+	}
+}
+
+// initConnection sends connection_init with payload and waits for
+// connection_ack.
+func initConnection(t *testing.T, ws *websocket.Conn, payload map[string]interface{}) {
+	t.Helper()
+	writeMessage(t, ws, map[string]interface{}{"type": gqlConnectionInit, "payload": payload})
+	if msg := readMessage(t, ws); msg["type"] != gqlConnectionAck {
+		t.Fatalf("received %v, want connection_ack", msg)
+	}
+}
+
+func TestHandshakeTransportCloseCodes(t *testing.T) {
+	srv := newTestServer(t, ConnectionEventHandlers{}, ConnectionInitTimeout(50*time.Millisecond))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		messages []map[string]interface{}
+		want     int
+	}{
+		{name: "init timeout", want: closeInitTimeout},
+		{
+			name: "subscribe before init",
+			messages: []map[string]interface{}{
+				{"id": "1", "type": gqlSubscribe, "payload": map[string]interface{}{"query": "subscription { ping }"}},
+			},
+			want: closeUnauthorized,
+		},
+		{
+			name: "second init",
+			messages: []map[string]interface{}{
+				{"type": gqlConnectionInit},
+				{"type": gqlConnectionInit},
+			},
+			want: closeTooManyInitRequests,
+		},
+		{
+			name:     "unknown message",
+			messages: []map[string]interface{}{{"type": "shout"}},
+			want:     closeBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := dial(t, srv.URL, protocolGraphQLTransportWS)
+			defer ws.Close()
+			for _, msg := range tt.messages {
+				writeMessage(t, ws, msg)
+			}
+			if code := readClose(t, ws); code != tt.want {
+				t.Errorf("close code = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeLegacyConnectionError(t *testing.T) {
+	srv := newTestServer(t, ConnectionEventHandlers{}, ConnectionInitTimeout(50*time.Millisecond))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		messages []map[string]interface{}
+		want     string
+	}{
+		{name: "init timeout", want: "Connection initialisation timeout"},
+		{
+			name: "start before init",
+			messages: []map[string]interface{}{
+				{"id": "1", "type": gqlStart, "payload": map[string]interface{}{"query": "subscription { ping }"}},
+			},
+			want: "Unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := dial(t, srv.URL, "")
+			defer ws.Close()
+			if ws.Subprotocol() != "" {
+				t.Fatalf("negotiated %q without offering a subprotocol", ws.Subprotocol())
+			}
+			for _, msg := range tt.messages {
+				writeMessage(t, ws, msg)
+			}
+
+			msg := readMessage(t, ws)
+			payload, _ := msg["payload"].(map[string]interface{})
+			if msg["type"] != gqlConnectionError || payload["message"] != tt.want {
+				t.Errorf("received %v, want connection_error %q", msg, tt.want)
+			}
+			if code := readClose(t, ws); code != websocket.CloseNormalClosure {
+				t.Errorf("close code = %d, want %d", code, websocket.CloseNormalClosure)
+			}
+		})
+	}
+}
+
+func TestHandshakeOnConnect(t *testing.T) {
+	type tokenKey struct{}
+	started := make(chan interface{}, 1)
+	var srv *testServer
+	srv = newTestServer(t, ConnectionEventHandlers{
+		OnConnect: func(ctx context.Context, payload map[string]interface{}) (context.Context, error) {
+			token, _ := payload["token"].(string)
+			if token == "" {
+				return nil, errors.New("missing token")
+			}
+			return context.WithValue(ctx, tokenKey{}, token), nil
+		},
+		Start: func(s *Subscription) error {
+			started <- s.Context.Value(tokenKey{})
+			return srv.sm.AddSubscription(s)
+		},
+	})
+	defer srv.Close()
+
+	t.Run("rejected", func(t *testing.T) {
+		ws := dial(t, srv.URL, protocolGraphQLTransportWS)
+		defer ws.Close()
+		writeMessage(t, ws, map[string]interface{}{"type": gqlConnectionInit})
+		if code := readClose(t, ws); code != closeForbidden {
+			t.Errorf("close code = %d, want %d", code, closeForbidden)
+		}
+	})
+
+	t.Run("rejected legacy", func(t *testing.T) {
+		ws := dial(t, srv.URL, protocolGraphQLWS)
+		defer ws.Close()
+		writeMessage(t, ws, map[string]interface{}{"type": gqlConnectionInit})
+		msg := readMessage(t, ws)
+		payload, _ := msg["payload"].(map[string]interface{})
+		if msg["type"] != gqlConnectionError || payload["message"] != "missing token" {
+			t.Errorf("received %v, want connection_error missing token", msg)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		ws := dial(t, srv.URL, protocolGraphQLTransportWS)
+		defer ws.Close()
+		initConnection(t, ws, map[string]interface{}{"token": "secret"})
+		writeMessage(t, ws, map[string]interface{}{
+			"id":      "1",
+			"type":    gqlSubscribe,
+			"payload": map[string]interface{}{"query": "subscription { ping }"},
+		})
+
+		select {
+		case token := <-started:
+			if token != "secret" {
+				t.Errorf("subscription context token = %v, want secret", token)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the subscription was not started")
+		}
+	})
+}
+
+func TestSubscriptionOverWebsocket(t *testing.T) {
+	for _, protocol := range []string{protocolGraphQLTransportWS, protocolGraphQLWS} {
+		t.Run(protocol, func(t *testing.T) {
+			srv := newTestServer(t, ConnectionEventHandlers{})
+			defer srv.Close()
+			ws := dial(t, srv.URL, protocol)
+			defer ws.Close()
+			initConnection(t, ws, nil)
+
+			start, data := gqlSubscribe, gqlNext
+			if protocol == protocolGraphQLWS {
+				start, data = gqlStart, gqlData
+			}
+			writeMessage(t, ws, map[string]interface{}{
+				"id":      "1",
+				"type":    start,
+				"payload": map[string]interface{}{"query": "subscription { ping }"},
+			})
+			waitSubscribed(t, srv.ps, 1)
+			srv.ps.Publish("ping", "pong")
+
+			msg := readMessage(t, ws)
+			payload, _ := msg["payload"].(map[string]interface{})
+			result, _ := payload["data"].(map[string]interface{})
+			if msg["type"] != data || msg["id"] != "1" || result["ping"] != "pong" {
+				t.Errorf("received %v, want %s of pong", msg, data)
+			}
+		})
+	}
+}
+
+// waitSubscribed waits until the pubsub has n subscribers.
+func waitSubscribed(t *testing.T, ps *fakePubSub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if subscribed, _ := ps.counts(); subscribed == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d subscribers", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionLastEventIDResumesOnce(t *testing.T) {
+	started := make(chan int64, 1)
+	handlers := ConnectionEventHandlers{
+		Start: func(s *Subscription) error {
+			started <- s.LastEventID
+			return nil
+		},
+		Stop: func(*websocket.Conn, string) {},
+	}
+	subscribe := func(t *testing.T, ws *websocket.Conn, id string) int64 {
+		t.Helper()
+		writeMessage(t, ws, map[string]interface{}{
+			"id":      id,
+			"type":    gqlSubscribe,
+			"payload": map[string]interface{}{"query": "subscription { ping }"},
+		})
+		select {
+		case lastEventID := <-started:
+			return lastEventID
+		case <-time.After(time.Second):
+			t.Fatalf("subscription %s was not started", id)
+			return 0
+		}
+	}
+
+	t.Run("first start of each operation ID", func(t *testing.T) {
+		srv := newTestServer(t, handlers)
+		defer srv.Close()
+		ws := dial(t, srv.URL, protocolGraphQLTransportWS)
+		defer ws.Close()
+		initConnection(t, ws, map[string]interface{}{"lastEventId": "5"})
+
+		if got := subscribe(t, ws, "1"); got != 5 {
+			t.Errorf("first subscription resumes after %d, want 5", got)
+		}
+		writeMessage(t, ws, map[string]interface{}{"id": "1", "type": gqlComplete})
+		if got := subscribe(t, ws, "1"); got != 0 {
+			t.Errorf("restarted subscription resumes after %d, want 0", got)
+		}
+		if got := subscribe(t, ws, "2"); got != 5 {
+			t.Errorf("second operation ID resumes after %d, want 5", got)
+		}
+	})
+
+	t.Run("after the window", func(t *testing.T) {
+		srv := newTestServer(t, handlers, ResumeWindow(10*time.Millisecond))
+		defer srv.Close()
+		ws := dial(t, srv.URL, protocolGraphQLTransportWS)
+		defer ws.Close()
+		initConnection(t, ws, map[string]interface{}{"lastEventId": "5"})
+
+		time.Sleep(20 * time.Millisecond)
+		if got := subscribe(t, ws, "1"); got != 0 {
+			t.Errorf("subscription after the window resumes after %d, want 0", got)
+		}
+	})
+}
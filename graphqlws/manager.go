@@ -1,13 +1,14 @@
 package graphqlws
 
 import (
+	"context"
 	"fmt"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
 	"github.com/graphql-go/graphql/language/ast"
-	"github.com/graphql-go/graphql/language/parser"
-	"github.com/graphql-go/graphql/language/source"
 	"github.com/pkg/errors"
 )
 
@@ -21,11 +22,62 @@ type PubSub interface {
 	Unsubscribe(subID string)
 }
 
+// OperationError is returned when an operation cannot be started, e.g.
+// because it fails to parse or validate. Errors are sent to the client.
+type OperationError struct {
+	Errors []gqlerrors.FormattedError
+}
+
+func (e *OperationError) Error() string {
+	if len(e.Errors) == 0 {
+		return "operation failed"
+	}
+	return e.Errors[0].Message
+}
+
+// ErrShuttingDown is returned when a subscription is added after the
+// subscription manager was shut down.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// TopicFunc maps the arguments of a subscription field to the topic the
+// subscription listens on.
+type TopicFunc func(args map[string]interface{}) string
+
+// FilterFunc reports whether an event payload should be sent to a
+// subscription with the given field arguments.
+type FilterFunc func(payload interface{}, args map[string]interface{}) bool
+
+// SubscriptionField customizes how the events of a subscription field are
+// routed. Fields without a SubscriptionField listen on the topic named
+// after the field.
+type SubscriptionField struct {
+	// Topic returns the topic for the given field arguments.
+	Topic TopicFunc
+	// Filter drops the events that don't match the field arguments
+	// before the subscription is executed.
+	Filter FilterFunc
+}
+
 // SubscriptionManager manages the graphQL subscriptions.
+// Subscriptions are owned by the connection that started them and are
+// identified by their ID within that connection. It is safe for
+// concurrent use.
 type SubscriptionManager struct {
-	PubSub        PubSub
-	Schema        *graphql.Schema
-	subscriptions map[string]*Subscription
+	PubSub PubSub
+	Schema *graphql.Schema
+	// EventLog replays the events missed by the subscriptions resuming
+	// after a last event ID. Subscriptions don't resume when it is nil.
+	EventLog EventLog
+	fields   map[string]SubscriptionField
+
+	mu            sync.Mutex
+	subscriptions map[*websocket.Conn]map[string]*Subscription
+	// connections maps the connections served by the handler to the
+	// functions shutting them down.
+	connections map[*websocket.Conn]func()
+	// drained is created by Shutdown and closed once every connection
+	// is gone.
+	drained chan struct{}
 }
 
 // CallBack is executed when an event is fired.
@@ -37,70 +89,280 @@ type Subscription struct {
 	RequestString string
 	Variables     map[string]interface{}
 	OperationName string
-	Conn          *websocket.Conn
-	CallBack      CallBack
-	SubscriberID  string
+	// Context is the context the subscription is executed with.
+	Context  context.Context
+	Conn     *websocket.Conn
+	CallBack CallBack
+	// ReplayCallBack is called with the results of the replayed events.
+	// Defaults to CallBack.
+	ReplayCallBack CallBack
+	// LastEventID is the ID of the last event the client received. The
+	// subscription first replays the logged events published after it.
+	// Zero starts with the events published from now on.
+	LastEventID int64
+	// OnComplete is called when the server ends the subscription.
+	OnComplete func()
+	// OnError is called when the subscription ends because replaying the
+	// events after LastEventID failed.
+	OnError      func(error)
+	SubscriberID string
+
+	// stopReplay stops the replay of a resuming subscription.
+	stopReplay context.CancelFunc
 }
 
 // NewSubscriptionManager creates a new subscription manager.
-func NewSubscriptionManager(schema *graphql.Schema, ps PubSub) *SubscriptionManager {
+// fields customizes the subscription fields by name and may be nil.
+func NewSubscriptionManager(schema *graphql.Schema, ps PubSub,
+	fields map[string]SubscriptionField) *SubscriptionManager {
 	return &SubscriptionManager{
 		Schema:        schema,
 		PubSub:        ps,
-		subscriptions: make(map[string]*Subscription),
+		fields:        fields,
+		subscriptions: make(map[*websocket.Conn]map[string]*Subscription),
+		connections:   make(map[*websocket.Conn]func()),
 	}
 }
 
 // AddSubscription adds a new subscription to the subscription manager.
+// A subscription with a LastEventID replays the events it missed in the
+// background; if that fails, it is removed and its OnError is called.
 func (sm *SubscriptionManager) AddSubscription(s *Subscription) error {
-	source := source.NewSource(&source.Source{
-		Body: []byte(s.RequestString),
-		Name: "GraphQL subscription request",
-	})
-	document, err := parser.Parse(parser.ParseParams{Source: source})
+	document, operation, err := parseOperation(sm.Schema, s.RequestString, s.OperationName)
 	if err != nil {
-		return errors.Wrap(err, "failed to parse subscription query")
+		return err
 	}
-	validation := graphql.ValidateDocument(sm.Schema, document, graphql.SpecifiedRules)
-	if !validation.IsValid {
-		return fmt.Errorf("subscription query validation failed: %#v", validation.Errors)
+	if operation.Operation != ast.OperationTypeSubscription {
+		return fmt.Errorf("expected a subscription operation, got %s", operation.Operation)
 	}
+	fields := rootFields(document, operation)
+	if len(fields) != 1 {
+		return errors.New("subscription must select exactly one root field")
+	}
+	rootField := fields[0]
 
-	var subscriptionName string
-	var args map[string]interface{}
-	for _, node := range document.Definitions {
-		if node.GetKind() == "OperationDefinition" {
-			def, _ := node.(*ast.OperationDefinition)
-			rootField, _ := def.GetSelectionSet().Selections[0].(*ast.Field)
-			subscriptionName = rootField.Name.Value
+	subscriptionType := sm.Schema.SubscriptionType()
+	if subscriptionType == nil {
+		return errors.New("schema does not support subscriptions")
+	}
+	fieldName := rootField.Name.Value
+	fieldDef, ok := subscriptionType.Fields()[fieldName]
+	if !ok {
+		return fmt.Errorf("unknown subscription field %q", fieldName)
+	}
+	args, err := getArgumentValues(fieldDef.Args, rootField.Arguments, s.Variables)
+	if err != nil {
+		return errors.Wrap(err, "invalid subscription arguments")
+	}
 
-			fields := sm.Schema.SubscriptionType().Fields()
-			args, err = getArgumentValues(fields[subscriptionName].Args, rootField.Arguments, s.Variables)
-			break
-		}
+	field := sm.fields[fieldName]
+	topic := fieldName
+	if field.Topic != nil {
+		topic = field.Topic(args)
 	}
 
-	sID := sm.PubSub.Subscribe("userCreated", func(payload interface{}) error {
+	// execute runs the subscription for an event and passes its result
+	// to callback
+	execute := func(payload interface{}, callback CallBack) error {
+		var eventID int64
+		if e, ok := payload.(LoggedEvent); ok {
+			eventID, payload = e.ID, e.Payload
+		}
+		if field.Filter != nil && !field.Filter(payload, args) {
+			return nil
+		}
 		result := graphql.Execute(graphql.ExecuteParams{
 			Schema:        *sm.Schema,
 			AST:           document,
 			OperationName: s.OperationName,
-			Args:          args,
+			Args:          s.Variables,
 			Root:          payload,
+			Context:       s.Context,
 		})
-		return s.CallBack(result)
-	})
+		if eventID != 0 {
+			result.Extensions = map[string]interface{}{"eventId": eventID}
+		}
+		return callback(result)
+	}
+	handler := func(payload interface{}) error {
+		return execute(payload, s.CallBack)
+	}
+	var r *resumer
+	if s.LastEventID > 0 && sm.EventLog != nil {
+		r = newResumer(handler)
+		handler = r.handle
+	}
+
+	sm.mu.Lock()
+	if sm.drained != nil {
+		sm.mu.Unlock()
+		return ErrShuttingDown
+	}
+	connSubs, ok := sm.subscriptions[s.Conn]
+	if !ok {
+		connSubs = make(map[string]*Subscription)
+		sm.subscriptions[s.Conn] = connSubs
+	}
+	if _, exists := connSubs[s.ID]; exists {
+		sm.mu.Unlock()
+		return fmt.Errorf("subscription %q already exists", s.ID)
+	}
 
 	// add new subscription
-	s.SubscriberID = sID
-	sm.subscriptions[s.ID] = s
+	var ctx context.Context
+	if r != nil {
+		ctx, s.stopReplay = context.WithCancel(s.Context)
+	}
+	s.SubscriberID = sm.PubSub.Subscribe(topic, handler)
+	connSubs[s.ID] = s
+	sm.mu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+
+	// live events are held back until the missed ones are replayed,
+	// which may take long, so the caller doesn't wait for it
+	go func() {
+		err := sm.replay(ctx, s, topic, r, execute)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if _, ok := sm.removeSubscription(s.Conn, s.ID); ok && s.OnError != nil {
+			s.OnError(err)
+		}
+	}()
 	return nil
 }
 
-// RemoveSubscription removes the a previously added subscription.
-func (sm *SubscriptionManager) RemoveSubscription(subscriptionID string) {
-	subID := sm.subscriptions[subscriptionID].SubscriberID
-	sm.PubSub.Unsubscribe(subID)
-	// delete subscription
-	delete(sm.subscriptions, subscriptionID)
+// replay sends the events logged after the last event ID of s and then
+// the live events held back by r.
+func (sm *SubscriptionManager) replay(ctx context.Context, s *Subscription, topic string,
+	r *resumer, execute func(interface{}, CallBack) error) error {
+	events, err := sm.EventLog.EventsAfter(ctx, topic, s.LastEventID)
+	if err != nil {
+		return err
+	}
+
+	callback := s.ReplayCallBack
+	if callback == nil {
+		callback = s.CallBack
+	}
+	return r.finish(ctx, events, func(payload interface{}) error {
+		return execute(payload, callback)
+	})
+}
+
+// RemoveSubscription removes a subscription previously added by conn.
+func (sm *SubscriptionManager) RemoveSubscription(conn *websocket.Conn, subscriptionID string) {
+	sm.removeSubscription(conn, subscriptionID)
+}
+
+// CompleteSubscription ends a subscription on the server side, notifying
+// the client that no more results will be sent.
+func (sm *SubscriptionManager) CompleteSubscription(conn *websocket.Conn, subscriptionID string) {
+	s, ok := sm.removeSubscription(conn, subscriptionID)
+	if ok && s.OnComplete != nil {
+		s.OnComplete()
+	}
+}
+
+func (sm *SubscriptionManager) removeSubscription(conn *websocket.Conn, subscriptionID string) (*Subscription, bool) {
+	sm.mu.Lock()
+	s, ok := sm.subscriptions[conn][subscriptionID]
+	if ok {
+		delete(sm.subscriptions[conn], subscriptionID)
+		if len(sm.subscriptions[conn]) == 0 {
+			delete(sm.subscriptions, conn)
+		}
+	}
+	sm.mu.Unlock()
+
+	if ok {
+		sm.unsubscribe(s)
+	}
+	return s, ok
+}
+
+// RemoveConnection removes every subscription added by conn.
+func (sm *SubscriptionManager) RemoveConnection(conn *websocket.Conn) {
+	sm.mu.Lock()
+	connSubs := sm.subscriptions[conn]
+	delete(sm.subscriptions, conn)
+	if _, ok := sm.connections[conn]; ok {
+		delete(sm.connections, conn)
+		if sm.drained != nil && len(sm.connections) == 0 {
+			close(sm.drained)
+		}
+	}
+	sm.mu.Unlock()
+
+	for _, s := range connSubs {
+		sm.unsubscribe(s)
+	}
+}
+
+// unsubscribe stops the events of a removed subscription.
+func (sm *SubscriptionManager) unsubscribe(s *Subscription) {
+	if s.stopReplay != nil {
+		s.stopReplay()
+	}
+	sm.PubSub.Unsubscribe(s.SubscriberID)
+}
+
+// Shutdown completes every subscription and asks every connection to
+// close with the going away close code once its running operations have
+// finished. It waits until the connections are gone or ctx is done.
+// Subscriptions cannot be added afterwards.
+func (sm *SubscriptionManager) Shutdown(ctx context.Context) error {
+	sm.mu.Lock()
+	if sm.drained == nil {
+		sm.drained = make(chan struct{})
+		if len(sm.connections) == 0 {
+			close(sm.drained)
+		}
+	}
+	var subs []*Subscription
+	for _, connSubs := range sm.subscriptions {
+		for _, s := range connSubs {
+			subs = append(subs, s)
+		}
+	}
+	sm.subscriptions = make(map[*websocket.Conn]map[string]*Subscription)
+	shutdowns := make([]func(), 0, len(sm.connections))
+	for _, shutdown := range sm.connections {
+		shutdowns = append(shutdowns, shutdown)
+	}
+	drained := sm.drained
+	sm.mu.Unlock()
+
+	for _, s := range subs {
+		sm.unsubscribe(s)
+		if s.OnComplete != nil {
+			s.OnComplete()
+		}
+	}
+	for _, shutdown := range shutdowns {
+		shutdown()
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addConnection registers a connection served by the handler. It returns
+// false when the manager is shutting down.
+func (sm *SubscriptionManager) addConnection(conn *websocket.Conn, shutdown func()) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.drained != nil {
+		return false
+	}
+	sm.connections[conn] = shutdown
+	return true
 }
@@ -0,0 +1,342 @@
+package graphqlws
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+)
+
+// fakePubSub records the subscribers and can publish to them
+// synchronously.
+type fakePubSub struct {
+	mu           sync.Mutex
+	next         int
+	handlers     map[string]Handler
+	topics       map[string]string
+	unsubscribed int
+}
+
+func newFakePubSub() *fakePubSub {
+	return &fakePubSub{handlers: make(map[string]Handler), topics: make(map[string]string)}
+}
+
+func (ps *fakePubSub) Subscribe(event string, handler Handler) string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.next++
+	id := strconv.Itoa(ps.next)
+	ps.handlers[id] = handler
+	ps.topics[id] = event
+	return id
+}
+
+func (ps *fakePubSub) Publish(event string, payload interface{}) {
+	ps.mu.Lock()
+	var handlers []Handler
+	for id, handler := range ps.handlers {
+		if ps.topics[id] == event {
+			handlers = append(handlers, handler)
+		}
+	}
+	ps.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(payload)
+	}
+}
+
+func (ps *fakePubSub) Unsubscribe(subID string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.handlers[subID]; ok {
+		delete(ps.handlers, subID)
+		delete(ps.topics, subID)
+		ps.unsubscribed++
+	}
+}
+
+func (ps *fakePubSub) counts() (subscribed, unsubscribed int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.handlers), ps.unsubscribed
+}
+
+func newTestSchema(t *testing.T) *graphql.Schema {
+	t.Helper()
+	root := graphql.Fields{
+		"ping": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Info.RootValue, nil
+			},
+		},
+	}
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:        graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: root}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: root}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+func newTestSubscription(conn *websocket.Conn, id string, callback CallBack) *Subscription {
+	return &Subscription{
+		ID:            id,
+		RequestString: "subscription { ping }",
+		Context:       context.Background(),
+		Conn:          conn,
+		CallBack:      callback,
+	}
+}
+
+func ignoreResult(*graphql.Result) error { return nil }
+
+func TestSubscriptionManagerConcurrentConnections(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 8; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			conn := &websocket.Conn{}
+			for i := 0; i < 20; i++ {
+				id := strconv.Itoa(i)
+				if err := sm.AddSubscription(newTestSubscription(conn, id, ignoreResult)); err != nil {
+					t.Errorf("AddSubscription(%d, %s) error = %v", c, id, err)
+					return
+				}
+				if i%2 == 0 {
+					sm.RemoveSubscription(conn, id)
+				}
+			}
+			go ps.Publish("ping", "pong")
+			sm.RemoveConnection(conn)
+		}(c)
+	}
+	wg.Wait()
+
+	if subscribed, unsubscribed := ps.counts(); subscribed != 0 || unsubscribed != 8*20 {
+		t.Errorf("subscribed = %d, unsubscribed = %d, want 0 and %d", subscribed, unsubscribed, 8*20)
+	}
+}
+
+func TestSubscriptionManagerSameIDOnTwoConnections(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	callback := func(name string) CallBack {
+		return func(*graphql.Result) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			return nil
+		}
+	}
+
+	a, b := &websocket.Conn{}, &websocket.Conn{}
+	if err := sm.AddSubscription(newTestSubscription(a, "1", callback("a"))); err != nil {
+		t.Fatalf("AddSubscription(a) error = %v", err)
+	}
+	if err := sm.AddSubscription(newTestSubscription(b, "1", callback("b"))); err != nil {
+		t.Fatalf("AddSubscription(b) error = %v", err)
+	}
+	if err := sm.AddSubscription(newTestSubscription(a, "1", ignoreResult)); err == nil {
+		t.Error("AddSubscription() of a duplicate ID on the same connection error = nil")
+	}
+
+	ps.Publish("ping", "pong")
+	sm.RemoveSubscription(a, "1")
+	ps.Publish("ping", "pong")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if received["a"] != 1 || received["b"] != 2 {
+		t.Errorf("received = %v, want a once and b twice", received)
+	}
+}
+
+func TestSubscriptionManagerRemoveConnection(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+
+	conn, other := &websocket.Conn{}, &websocket.Conn{}
+	for i := 0; i < 3; i++ {
+		if err := sm.AddSubscription(newTestSubscription(conn, fmt.Sprint(i), ignoreResult)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sm.AddSubscription(newTestSubscription(other, "0", ignoreResult)); err != nil {
+		t.Fatal(err)
+	}
+
+	sm.RemoveConnection(conn)
+	if subscribed, unsubscribed := ps.counts(); subscribed != 1 || unsubscribed != 3 {
+		t.Errorf("subscribed = %d, unsubscribed = %d, want 1 and 3", subscribed, unsubscribed)
+	}
+
+	// removing it again is a no-op
+	sm.RemoveConnection(conn)
+	if _, unsubscribed := ps.counts(); unsubscribed != 3 {
+		t.Errorf("unsubscribed = %d after a second RemoveConnection, want 3", unsubscribed)
+	}
+}
+
+// fakeEventLog returns its events once release is closed, or the error of
+// its context.
+type fakeEventLog struct {
+	events  []LoggedEvent
+	err     error
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (l *fakeEventLog) EventsAfter(ctx context.Context, topic string, id int64) ([]LoggedEvent, error) {
+	defer close(l.done)
+	select {
+	case <-l.release:
+		return l.events, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func newResumingSubscription(conn *websocket.Conn, results chan<- string) *Subscription {
+	s := newTestSubscription(conn, "1", func(result *graphql.Result) error {
+		results <- fmt.Sprintf("%v@%v", result.Data.(map[string]interface{})["ping"], result.Extensions["eventId"])
+		return nil
+	})
+	s.LastEventID = 1
+	return s
+}
+
+func TestSubscriptionManagerResume(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+	log := &fakeEventLog{
+		events:  []LoggedEvent{{ID: 2, Payload: "b"}, {ID: 3, Payload: "c"}},
+		release: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	sm.EventLog = log
+
+	results := make(chan string, 10)
+	if err := sm.AddSubscription(newResumingSubscription(&websocket.Conn{}, results)); err != nil {
+		t.Fatalf("AddSubscription() error = %v", err)
+	}
+
+	// live events are held back, not blocking the pubsub, while the
+	// replay is waiting
+	ps.Publish("ping", LoggedEvent{ID: 3, Payload: "c"})
+	ps.Publish("ping", LoggedEvent{ID: 4, Payload: "d"})
+	close(log.release)
+
+	for _, want := range []string{"b@2", "c@3", "d@4"} {
+		select {
+		case got := <-results:
+			if got != want {
+				t.Fatalf("received %s, want %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	ps.Publish("ping", LoggedEvent{ID: 5, Payload: "e"})
+	select {
+	case got := <-results:
+		if got != "e@5" {
+			t.Errorf("received %s after the replay, want e@5", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for e@5")
+	}
+}
+
+func TestSubscriptionManagerResumeFails(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+	release := make(chan struct{})
+	close(release)
+	sm.EventLog = &fakeEventLog{err: ErrResumeUnavailable, release: release, done: make(chan struct{})}
+
+	s := newResumingSubscription(&websocket.Conn{}, make(chan string, 1))
+	failed := make(chan error, 1)
+	s.OnError = func(err error) { failed <- err }
+	if err := sm.AddSubscription(s); err != nil {
+		t.Fatalf("AddSubscription() error = %v", err)
+	}
+
+	select {
+	case err := <-failed:
+		if err != ErrResumeUnavailable {
+			t.Errorf("OnError(%v), want ErrResumeUnavailable", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnError was not called")
+	}
+	if subscribed, unsubscribed := ps.counts(); subscribed != 0 || unsubscribed != 1 {
+		t.Errorf("subscribed = %d, unsubscribed = %d, want the subscription removed", subscribed, unsubscribed)
+	}
+}
+
+func TestSubscriptionManagerStopDuringResume(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+	log := &fakeEventLog{release: make(chan struct{}), done: make(chan struct{})}
+	sm.EventLog = log
+
+	conn := &websocket.Conn{}
+	s := newResumingSubscription(conn, make(chan string, 1))
+	s.OnError = func(err error) { t.Errorf("OnError(%v) after the subscription was stopped", err) }
+	if err := sm.AddSubscription(s); err != nil {
+		t.Fatalf("AddSubscription() error = %v", err)
+	}
+
+	sm.RemoveSubscription(conn, s.ID)
+	select {
+	case <-log.done:
+	case <-time.After(time.Second):
+		t.Fatal("the replay was not stopped")
+	}
+	// give a wrongly called OnError the time to run
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestSubscriptionManagerShutdownDuringResume(t *testing.T) {
+	ps := newFakePubSub()
+	sm := NewSubscriptionManager(newTestSchema(t), ps, nil)
+	log := &fakeEventLog{release: make(chan struct{}), done: make(chan struct{})}
+	sm.EventLog = log
+
+	s := newResumingSubscription(&websocket.Conn{}, make(chan string, 1))
+	s.OnError = func(err error) { t.Errorf("OnError(%v) after the manager was shut down", err) }
+	if err := sm.AddSubscription(s); err != nil {
+		t.Fatalf("AddSubscription() error = %v", err)
+	}
+
+	if err := sm.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	select {
+	case <-log.done:
+	case <-time.After(time.Second):
+		t.Fatal("the replay was not stopped")
+	}
+	if subscribed, _ := ps.counts(); subscribed != 0 {
+		t.Errorf("subscribed = %d after Shutdown, want 0", subscribed)
+	}
+	// give a wrongly called OnError the time to run
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package graphqlws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := newRateLimiter(2, 2)
+	start := l.last
+
+	tests := []struct {
+		after time.Duration
+		want  time.Duration
+	}{
+		// the burst is available right away
+		{0, 0},
+		{0, 0},
+		// then a token every half second
+		{0, 500 * time.Millisecond},
+		{0, time.Second},
+		// waiting pays back the debt
+		{time.Second, 500 * time.Millisecond},
+		// an idle bucket refills up to the burst only
+		{time.Minute, 0},
+		{time.Minute, 0},
+		{time.Minute, 500 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		if got := l.reserve(start.Add(tt.after)); got != tt.want {
+			t.Errorf("reserve %d at +%v = %v, want %v", i, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterMinimumBurst(t *testing.T) {
+	l := newRateLimiter(1, 0)
+	if got := l.reserve(l.last); got != 0 {
+		t.Errorf("first reserve = %v, want a burst of one", got)
+	}
+	if got := l.reserve(l.last); got != time.Second {
+		t.Errorf("second reserve = %v, want 1s", got)
+	}
+}
+
+func TestRateLimitThrottlesConnection(t *testing.T) {
+	srv := newTestServer(t, ConnectionEventHandlers{}, RateLimit(20, 1))
+	defer srv.Close()
+	ws := dial(t, srv.URL, protocolGraphQLTransportWS)
+	defer ws.Close()
+
+	start := time.Now()
+	initConnection(t, ws, nil)
+	for i := 0; i < 4; i++ {
+		writeMessage(t, ws, map[string]interface{}{"type": gqlPing})
+	}
+	for i := 0; i < 4; i++ {
+		if msg := readMessage(t, ws); msg["type"] != gqlPong {
+			t.Fatalf("received %v, want pong", msg)
+		}
+	}
+
+	// the read loop waits after handling a message: with a burst of one,
+	// the last pong follows three 50ms waits
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("answered five messages in %v, want at least 150ms at 20 per second", elapsed)
+	}
+}
@@ -0,0 +1,163 @@
+package graphqlws
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// OverflowPolicy decides what happens to a message sent to a connection
+// whose send queue is full.
+type OverflowPolicy int
+
+const (
+	// DisconnectSlowConsumer closes the connection with the
+	// CloseTryAgainLater (1013) close code.
+	DisconnectSlowConsumer OverflowPolicy = iota
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest
+	// DropNewest discards the message being sent.
+	DropNewest
+)
+
+var (
+	// ErrConnectionClosed is returned when sending to a closed connection.
+	ErrConnectionClosed = errors.New("connection closed")
+	// ErrMessageDropped is returned when a message is discarded because
+	// the send queue is full.
+	ErrMessageDropped = errors.New("message dropped; send queue is full")
+)
+
+// outbound is a message queued for the connection's writer.
+type outbound struct {
+	message interface{}
+	// closeMessage is sent as a close frame, after which the writer stops.
+	closeMessage []byte
+}
+
+// writePump writes the queued messages to the socket until a write fails
+// or the close frame is written. Once the connection is done, the messages
+// still queued are flushed. It is the only goroutine writing data frames.
+func (c *connection) writePump() {
+	defer close(c.writerDone)
+
+	for {
+		select {
+		case out := <-c.sendQueue:
+			if !c.write(out) {
+				return
+			}
+		case <-c.done:
+			for {
+				select {
+				case out := <-c.sendQueue:
+					if !c.write(out) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a single queued message. It returns false when the writer
+// should stop.
+func (c *connection) write(out outbound) bool {
+	if out.closeMessage != nil {
+		err := c.ws.WriteControl(websocket.CloseMessage, out.closeMessage,
+			time.Now().Add(writeWait))
+		if err != nil {
+			c.log.Warn("failed to write close message", "error", err)
+			c.ws.Close()
+		}
+		return false
+	}
+
+	if c.handler.writeTimeout > 0 {
+		c.ws.SetWriteDeadline(time.Now().Add(c.handler.writeTimeout))
+	}
+	if err := c.ws.WriteJSON(out.message); err != nil {
+		c.log.Warn("failed to write to ws connection", "error", err)
+		c.ws.Close()
+		return false
+	}
+	return true
+}
+
+// send queues v to be written as a JSON message. It never blocks; when
+// the queue is full the handler's OverflowPolicy applies.
+func (c *connection) send(v interface{}) error {
+	out := outbound{message: v}
+	for {
+		if atomic.LoadInt32(&c.closing) == 1 {
+			return ErrConnectionClosed
+		}
+		select {
+		case <-c.writerDone:
+			return ErrConnectionClosed
+		case c.sendQueue <- out:
+			return nil
+		default:
+		}
+
+		switch c.handler.overflow {
+		case DropNewest:
+			return ErrMessageDropped
+		case DropOldest:
+			select {
+			case <-c.sendQueue:
+			default:
+			}
+		default:
+			c.closeWithCode(websocket.CloseTryAgainLater, "Slow consumer")
+			return ErrConnectionClosed
+		}
+	}
+}
+
+// sendWait queues v like send but waits for room in the queue instead of
+// applying the OverflowPolicy, until ctx is done.
+func (c *connection) sendWait(ctx context.Context, v interface{}) error {
+	if atomic.LoadInt32(&c.closing) == 1 {
+		return ErrConnectionClosed
+	}
+	select {
+	case <-c.writerDone:
+		return ErrConnectionClosed
+	case c.sendQueue <- outbound{message: v}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closeWithCode closes the connection with the given close code once the
+// messages already queued have been written. Nothing can be sent after.
+// The client has the close grace period to answer the close frame before
+// the read loop gives up on it.
+func (c *connection) closeWithCode(code int, reason string) {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return
+	}
+	c.ws.SetReadDeadline(time.Now().Add(c.handler.closeGracePeriod))
+
+	msg := websocket.FormatCloseMessage(code, reason)
+	select {
+	case c.sendQueue <- outbound{closeMessage: msg}:
+		return
+	case <-c.writerDone:
+	default:
+	}
+
+	// the queue is full or the writer is gone; close right away
+	err := c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	if err != nil {
+		c.log.Warn("failed to write close message", "error", err)
+	}
+	c.ws.Close()
+}
@@ -0,0 +1,199 @@
+package graphqlws
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketPair connects a client to a server socket and returns both with a
+// function closing them.
+func socketPair(t *testing.T) (server, client *websocket.Conn, closeFn func()) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+		conns <- ws
+	}))
+
+	client, _, err := websocket.DefaultDialer.Dial(wsURL(srv.URL), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("Dial() error = %v", err)
+	}
+	server = <-conns
+	return server, client, func() {
+		client.Close()
+		server.Close()
+		srv.Close()
+	}
+}
+
+// newTestConnection wraps ws in a connection configured by options. Its
+// writer is not started.
+func newTestConnection(ws *websocket.Conn, options ...Option) *connection {
+	options = append([]Option{Logger(testLogger)}, options...)
+	gws := NewHandler(websocket.Upgrader{}, nil, ConnectionEventHandlers{}, options...).(*graphqlWS)
+	c := &connection{
+		ctx:        context.Background(),
+		ws:         ws,
+		protocol:   protocolGraphQLTransportWS,
+		handler:    gws,
+		log:        gws.log,
+		sendQueue:  make(chan outbound, gws.sendQueueSize),
+		done:       make(chan struct{}),
+		writerDone: make(chan struct{}),
+		operations: make(map[string]bool),
+	}
+	c.opsCond = sync.NewCond(&c.opsMu)
+	return c
+}
+
+// queued drains the messages queued on c.
+func queued(c *connection) []interface{} {
+	var messages []interface{}
+	for {
+		select {
+		case out := <-c.sendQueue:
+			messages = append(messages, out.message)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestSendOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  OverflowPolicy
+		wantErr error
+		want    []interface{}
+	}{
+		{name: "drop newest", policy: DropNewest, wantErr: ErrMessageDropped, want: []interface{}{"a"}},
+		{name: "drop oldest", policy: DropOldest, want: []interface{}{"b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, closeFn := socketPair(t)
+			defer closeFn()
+			c := newTestConnection(server, SendQueue(1, tt.policy))
+
+			if err := c.send("a"); err != nil {
+				t.Fatalf("send(a) error = %v", err)
+			}
+			if err := c.send("b"); err != tt.wantErr {
+				t.Errorf("send(b) error = %v, want %v", err, tt.wantErr)
+			}
+			got := queued(c)
+			if len(got) != len(tt.want) || got[0] != tt.want[0] {
+				t.Errorf("queued %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendDisconnectsSlowConsumer(t *testing.T) {
+	server, client, closeFn := socketPair(t)
+	defer closeFn()
+	c := newTestConnection(server, SendQueue(1, DisconnectSlowConsumer))
+
+	if err := c.send("a"); err != nil {
+		t.Fatalf("send(a) error = %v", err)
+	}
+	if err := c.send("b"); err != ErrConnectionClosed {
+		t.Errorf("send(b) error = %v, want ErrConnectionClosed", err)
+	}
+	if err := c.send("c"); err != ErrConnectionClosed {
+		t.Errorf("send(c) after the disconnect error = %v, want ErrConnectionClosed", err)
+	}
+	if code := readClose(t, client); code != websocket.CloseTryAgainLater {
+		t.Errorf("close code = %d, want %d", code, websocket.CloseTryAgainLater)
+	}
+}
+
+func TestCloseWithCodeFlushesQueue(t *testing.T) {
+	server, client, closeFn := socketPair(t)
+	defer closeFn()
+	c := newTestConnection(server)
+	go c.writePump()
+
+	if err := c.send(map[string]interface{}{"type": "next"}); err != nil {
+		t.Fatalf("send() error = %v", err)
+	}
+	c.closeWithCode(closeBadRequest, "Bad request")
+	if err := c.send(map[string]interface{}{"type": "next"}); err != ErrConnectionClosed {
+		t.Errorf("send() after closeWithCode error = %v, want ErrConnectionClosed", err)
+	}
+
+	if msg := readMessage(t, client); msg["type"] != "next" {
+		t.Errorf("received %v before the close frame, want the queued message", msg)
+	}
+	if code := readClose(t, client); code != closeBadRequest {
+		t.Errorf("close code = %d, want %d", code, closeBadRequest)
+	}
+	select {
+	case <-c.writerDone:
+	case <-time.After(time.Second):
+		t.Error("the writer did not stop after the close frame")
+	}
+}
+
+func TestCloseGracePeriod(t *testing.T) {
+	server, _, closeFn := socketPair(t)
+	defer closeFn()
+	grace := 50 * time.Millisecond
+	c := newTestConnection(server, CloseGracePeriod(grace))
+	go c.writePump()
+
+	// the client never reads, so it does not answer the close frame
+	start := time.Now()
+	c.closeWithCode(websocket.CloseNormalClosure, "")
+	_, _, err := server.ReadMessage()
+	elapsed := time.Since(start)
+
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Fatalf("ReadMessage() error = %v, want a timeout", err)
+	}
+	if elapsed < grace || elapsed > time.Second {
+		t.Errorf("read loop gave up after %v, want about %v", elapsed, grace)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	server, _, closeFn := socketPair(t)
+	defer closeFn()
+	c := newTestConnection(server, WriteTimeout(50*time.Millisecond), SendQueue(1, DropNewest))
+	go c.writePump()
+
+	// the client never reads; once the socket buffers are full a write
+	// blocks until the deadline and the writer gives up
+	big := strings.Repeat("x", 1<<20)
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-c.writerDone:
+			if err := c.send(big); err != ErrConnectionClosed {
+				t.Errorf("send() after the write timeout error = %v, want ErrConnectionClosed", err)
+			}
+			return
+		case <-deadline:
+			t.Fatal("the writer did not time out")
+		default:
+		}
+		c.send(big)
+		time.Sleep(time.Millisecond)
+	}
+}
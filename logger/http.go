@@ -0,0 +1,34 @@
+package logger
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Middleware attaches a logger tagged with the request ID set by chi's
+// RequestID middleware to every request, and logs each request once it
+// has been served.
+func Middleware(l *Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			reqLog := l
+			if id := middleware.GetReqID(r.Context()); id != "" {
+				reqLog = l.With("request_id", id)
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(NewContext(r.Context(), reqLog)))
+
+			reqLog.Info("request served",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", ww.Status(),
+				"bytes", ww.BytesWritten(),
+				"duration", time.Since(start),
+				"remote", r.RemoteAddr)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Package logger provides a leveled, structured logger writing JSON or
+// key=value text lines.
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Log levels, from the most to the least verbose.
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// ParseLevel returns the level named by s, e.g. "info". The numbers of
+// the levels, 0 for debug to 3 for error, are accepted too.
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if _, ok := levelNames[Level(n)]; ok {
+			return Level(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format is the encoding of the log entries.
+type Format int
+
+const (
+	// TextFormat writes key=value pairs.
+	TextFormat Format = iota
+	// JSONFormat writes one JSON object per entry.
+	JSONFormat
+)
+
+// Logger writes leveled log entries carrying key/value fields. A nil
+// *Logger discards everything. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// output is shared by a logger and the loggers derived from it.
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+// New creates a logger writing the entries at or above level to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, level: level, format: format}}
+}
+
+var defaultLogger = New(os.Stderr, InfoLevel, TextFormat)
+
+// Default returns the logger writing info entries as text to stderr. It
+// is used by the packages that are not given a logger.
+func Default() *Logger {
+	return defaultLogger
+}
+
+// With returns a logger adding the given key/value pairs to every entry.
+// A key replaces a field with the same key.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		if !hasKey(keyvals, l.fields[i]) {
+			fields = append(fields, l.fields[i], l.fields[i+1])
+		}
+	}
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether entries at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.out.level
+}
+
+// Debug logs msg at debug level.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(DebugLevel, msg, keyvals)
+}
+
+// Info logs msg at info level.
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(InfoLevel, msg, keyvals)
+}
+
+// Warn logs msg at warn level.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(WarnLevel, msg, keyvals)
+}
+
+// Error logs msg at error level.
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(ErrorLevel, msg, keyvals)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	entry := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	entry = append(entry,
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		"msg", msg)
+	entry = append(entry, l.fields...)
+	entry = append(entry, keyvals...)
+	if len(entry)%2 != 0 {
+		entry = append(entry, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if l.out.format == JSONFormat {
+		encodeJSON(&buf, entry)
+	} else {
+		encodeText(&buf, entry)
+	}
+	buf.WriteByte('\n')
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func encodeJSON(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(keyvals[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(jsonValue(keyvals[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(keyvals[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func encodeText(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(keyvals[i]))
+		buf.WriteByte('=')
+		buf.WriteString(textValue(fmt.Sprint(keyvals[i+1])))
+	}
+}
+
+// textValue quotes values that would be ambiguous unquoted.
+func textValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func hasKey(keyvals []interface{}, key interface{}) bool {
+	for i := 0; i < len(keyvals); i += 2 {
+		if keyvals[i] == key {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or fallback when ctx
+// carries none.
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return l
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,63 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// PayloadTypeName returns the name a payload's type is known by when it
+// is carried as JSON, e.g. *data.User.
+func PayloadTypeName(payload interface{}) string {
+	if payload == nil {
+		return ""
+	}
+	return reflect.TypeOf(payload).String()
+}
+
+// PayloadTypes decodes the JSON payloads carried outside of the process
+// into the Go types they were published with. It is safe for concurrent
+// use.
+type PayloadTypes struct {
+	mu    sync.RWMutex
+	types map[string]reflect.Type
+}
+
+// NewPayloadTypes creates PayloadTypes knowing the types of the given
+// sample values.
+func NewPayloadTypes(samples ...interface{}) *PayloadTypes {
+	pt := &PayloadTypes{types: make(map[string]reflect.Type)}
+	pt.Register(samples...)
+	return pt
+}
+
+// Register adds the types of the given sample values.
+func (pt *PayloadTypes) Register(samples ...interface{}) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for _, sample := range samples {
+		pt.types[PayloadTypeName(sample)] = reflect.TypeOf(sample)
+	}
+}
+
+// Decode decodes raw into a value of the type named typeName. Payloads of
+// unknown types are decoded into generic JSON values.
+func (pt *PayloadTypes) Decode(typeName string, raw []byte) (interface{}, error) {
+	pt.mu.RLock()
+	t, ok := pt.types[typeName]
+	pt.mu.RUnlock()
+	if !ok {
+		var v interface{}
+		err := json.Unmarshal(raw, &v)
+		return v, err
+	}
+
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		err := json.Unmarshal(raw, v.Interface())
+		return v.Interface(), err
+	}
+	v := reflect.New(t)
+	err := json.Unmarshal(raw, v.Interface())
+	return v.Elem().Interface(), err
+}
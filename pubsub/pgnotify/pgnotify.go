@@ -0,0 +1,326 @@
+// Package pgnotify implements graphqlws.PubSub on top of Postgres
+// LISTEN/NOTIFY, so that an event published by one server reaches the
+// subscribers of every server sharing the database.
+package pgnotify
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dikaeinstein/go-graphql-api/graphqlws"
+	"github.com/dikaeinstein/go-graphql-api/logger"
+	"github.com/dikaeinstein/go-graphql-api/pubsub"
+	"github.com/lib/pq"
+)
+
+// maxNotifyPayload is the size from which Postgres rejects a notification
+// payload. Larger messages are stored in the pubsub_payloads table and
+// the notification only references them.
+const maxNotifyPayload = 8000
+
+// pingInterval is how long the listener may stay idle before its
+// connection is checked.
+const pingInterval = 90 * time.Second
+
+// message is an event as it travels through Postgres. Type names the Go
+// type of the payload and ID is set for a graphqlws.LoggedEvent.
+type message struct {
+	Event   string          `json:"event"`
+	ID      int64           `json:"id,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// notification is the payload of a notification: either a message, or
+// the ID of a message stored in the pubsub_payloads table.
+type notification struct {
+	message
+	Ref int64 `json:"ref,omitempty"`
+}
+
+// Option configures a PubSub.
+type Option func(*PubSub)
+
+// Channel option sets the notification channel shared by the servers.
+func Channel(name string) Option {
+	return func(ps *PubSub) {
+		ps.channel = name
+	}
+}
+
+// Logger option sets the logger reporting failed publishes and listener
+// reconnects.
+func Logger(l *logger.Logger) Option {
+	return func(ps *PubSub) {
+		ps.log = l
+	}
+}
+
+// Types option registers the Go types of the payloads, given as sample
+// values, so that subscribers receive payloads of the published type.
+// Payloads of other types are received as decoded JSON values.
+func Types(samples ...interface{}) Option {
+	return func(ps *PubSub) {
+		ps.types.Register(samples...)
+	}
+}
+
+// LocalOptions option configures the in-memory pubsub delivering the
+// received events to the subscribers of this server.
+func LocalOptions(options ...pubsub.Option) Option {
+	return func(ps *PubSub) {
+		ps.localOptions = append(ps.localOptions, options...)
+	}
+}
+
+// ReconnectInterval option sets how long the listener waits before
+// reconnecting, doubling from min up to max while attempts fail.
+func ReconnectInterval(min, max time.Duration) Option {
+	return func(ps *PubSub) {
+		ps.minReconnect = min
+		ps.maxReconnect = max
+	}
+}
+
+// minPayloadRetention is the shortest payload retention, leaving the
+// listeners time to read a stored message.
+const minPayloadRetention = time.Minute
+
+// PayloadRetention option sets how long messages too large for a
+// notification are kept in the pubsub_payloads table for the listeners
+// to read them. Retentions shorter than a minute are raised to a minute.
+func PayloadRetention(d time.Duration) Option {
+	return func(ps *PubSub) {
+		ps.retention = d
+	}
+}
+
+// PubSub implements the PubSub interface with Postgres notifications.
+// Published events are sent on a channel every server listens on, and
+// each server delivers the events it receives to its own subscribers, so
+// the publisher receives its events through Postgres too.
+type PubSub struct {
+	db           *sql.DB
+	listener     *pq.Listener
+	local        *pubsub.InMemoryPubSub
+	localOptions []pubsub.Option
+	channel      string
+	types        *pubsub.PayloadTypes
+	log          *logger.Logger
+	minReconnect time.Duration
+	maxReconnect time.Duration
+	retention    time.Duration
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// New creates a PubSub publishing through db and listening on a
+// dedicated connection opened with connStr, which is reopened whenever it
+// is lost. Events published while the listener is disconnected are not
+// received.
+func New(db *sql.DB, connStr string, options ...Option) (*PubSub, error) {
+	ps := &PubSub{
+		db:           db,
+		channel:      "graphql_events",
+		types:        pubsub.NewPayloadTypes(),
+		log:          logger.Default(),
+		minReconnect: time.Second,
+		maxReconnect: time.Minute,
+		retention:    time.Hour,
+		done:         make(chan struct{}),
+	}
+	for _, option := range options {
+		option(ps)
+	}
+	if ps.retention < minPayloadRetention {
+		ps.retention = minPayloadRetention
+	}
+	ps.local = pubsub.NewInMemoryPubSub(append([]pubsub.Option{pubsub.Logger(ps.log)}, ps.localOptions...)...)
+
+	ps.listener = pq.NewListener(connStr, ps.minReconnect, ps.maxReconnect, ps.onListenerEvent)
+	if err := ps.listener.Listen(ps.channel); err != nil {
+		ps.listener.Close()
+		return nil, err
+	}
+
+	ps.wg.Add(2)
+	go ps.listen()
+	go ps.purge()
+	return ps, nil
+}
+
+// Subscribe registers the given handler for the event. The event may
+// contain wildcards matching a single level each, as in the pubsub
+// package: userUpdated.* receives userUpdated.42 but not
+// userUpdated.42.name.
+func (ps *PubSub) Subscribe(event string, handler graphqlws.Handler) string {
+	return ps.local.Subscribe(event, handler)
+}
+
+// Unsubscribe removes the subscriber with given subID.
+func (ps *PubSub) Unsubscribe(subID string) {
+	ps.local.Unsubscribe(subID)
+}
+
+// Publish publishes to all subscribers of the given event on every
+// server. Failures are logged.
+func (ps *PubSub) Publish(event string, payload interface{}) {
+	if err := ps.PublishContext(context.Background(), event, payload); err != nil {
+		ps.log.Warn("failed to publish event", "event", event, "error", err)
+	}
+}
+
+// PublishContext is like Publish but returns the error.
+func (ps *PubSub) PublishContext(ctx context.Context, event string, payload interface{}) error {
+	var id int64
+	if e, ok := payload.(graphqlws.LoggedEvent); ok {
+		id, payload = e.ID, e.Payload
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode payload of %s: %v", event, err)
+	}
+	b, err := json.Marshal(message{Event: event, ID: id, Type: pubsub.PayloadTypeName(payload), Payload: raw})
+	if err != nil {
+		return err
+	}
+	if len(b) >= maxNotifyPayload {
+		var id int64
+		err := ps.db.QueryRowContext(ctx,
+			`INSERT INTO pubsub_payloads (message) VALUES ($1) RETURNING id;`, string(b)).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("store payload of %s: %v", event, err)
+		}
+		if b, err = json.Marshal(notification{Ref: id}); err != nil {
+			return err
+		}
+	}
+
+	_, err = ps.db.ExecContext(ctx, `SELECT pg_notify($1, $2);`, ps.channel, string(b))
+	return err
+}
+
+// Close stops listening and removes every subscriber.
+func (ps *PubSub) Close() error {
+	var err error
+	ps.closeOnce.Do(func() {
+		close(ps.done)
+		err = ps.listener.Close()
+		ps.wg.Wait()
+		ps.local.Close()
+	})
+	return err
+}
+
+// listen delivers the received notifications until the PubSub is closed.
+func (ps *PubSub) listen() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ps.done:
+			return
+		case n, ok := <-ps.listener.Notify:
+			if !ok {
+				return
+			}
+			// a nil notification follows a reconnect
+			if n != nil {
+				ps.receive(n.Extra)
+			}
+		case <-ticker.C:
+			go ps.listener.Ping()
+		}
+	}
+}
+
+// receive decodes a notification and publishes it to the local
+// subscribers.
+func (ps *PubSub) receive(extra string) {
+	var n notification
+	if err := json.Unmarshal([]byte(extra), &n); err != nil {
+		ps.log.Warn("invalid notification", "channel", ps.channel, "error", err)
+		return
+	}
+
+	m := n.message
+	if n.Ref != 0 {
+		var err error
+		if m, err = ps.load(n.Ref); err != nil {
+			ps.log.Warn("failed to load notification payload", "ref", n.Ref, "error", err)
+			return
+		}
+	}
+
+	payload, err := ps.types.Decode(m.Type, m.Payload)
+	if err != nil {
+		ps.log.Warn("invalid notification payload", "event", m.Event, "error", err)
+		return
+	}
+	if m.ID != 0 {
+		payload = graphqlws.LoggedEvent{ID: m.ID, Payload: payload}
+	}
+	ps.local.Publish(m.Event, payload)
+}
+
+// load reads the message stored in the pubsub_payloads table.
+func (ps *PubSub) load(id int64) (message, error) {
+	var m message
+	var raw string
+	err := ps.db.QueryRow(`SELECT message FROM pubsub_payloads WHERE id = $1;`, id).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, fmt.Errorf("payload %d expired", id)
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal([]byte(raw), &m)
+	return m, err
+}
+
+// purge deletes the stored messages older than the retention period
+// until the PubSub is closed.
+func (ps *PubSub) purge() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(ps.retention / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ps.done:
+			return
+		case <-ticker.C:
+			_, err := ps.db.Exec(`DELETE FROM pubsub_payloads WHERE created_at < $1;`,
+				time.Now().Add(-ps.retention))
+			if err != nil {
+				ps.log.Warn("failed to purge notification payloads", "error", err)
+			}
+		}
+	}
+}
+
+func (ps *PubSub) onListenerEvent(event pq.ListenerEventType, err error) {
+	select {
+	case <-ps.done:
+		return
+	default:
+	}
+
+	switch event {
+	case pq.ListenerEventDisconnected:
+		ps.log.Warn("notification listener disconnected", "error", err)
+	case pq.ListenerEventConnectionAttemptFailed:
+		ps.log.Warn("notification listener failed to connect", "error", err)
+	case pq.ListenerEventReconnected:
+		ps.log.Info("notification listener reconnected; events published while disconnected are lost")
+	}
+}
@@ -1,50 +1,239 @@
 package pubsub
 
 import (
-	"log"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dikaeinstein/go-graphql-api/graphqlws"
+	"github.com/dikaeinstein/go-graphql-api/logger"
 	"github.com/google/uuid"
 )
 
+// metrics counts the events published, delivered, dropped and failed
+// across every InMemoryPubSub.
+var metrics = expvar.NewMap("pubsub")
+
+// ErrBufferFull is reported when an event is dropped because the buffer
+// of a subscriber stayed full for the whole delivery timeout.
+var ErrBufferFull = errors.New("subscriber buffer is full")
+
+// ErrClosed is returned when publishing to a closed InMemoryPubSub.
+var ErrClosed = errors.New("pubsub is closed")
+
+// DeliveryError is reported when an event could not be delivered to a
+// subscriber.
+type DeliveryError struct {
+	Event        string
+	SubscriberID string
+	Err          error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("failed to deliver %s to subscriber %s: %v", e.Event, e.SubscriberID, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// PublishStats describes what happened to a published event.
+type PublishStats struct {
+	// Matched is the number of subscribers of the event.
+	Matched int
+	// Queued is the number of subscribers the event was queued for.
+	Queued int
+	// Dropped is the number of subscribers whose buffer was full.
+	Dropped int
+}
+
+// Option configures an InMemoryPubSub.
+type Option func(*InMemoryPubSub)
+
+// Logger option sets the logger reporting failed deliveries.
+func Logger(l *logger.Logger) Option {
+	return func(ps *InMemoryPubSub) {
+		ps.log = l
+	}
+}
+
+// BufferSize option sets how many events are queued per subscriber.
+func BufferSize(size int) Option {
+	return func(ps *InMemoryPubSub) {
+		ps.bufferSize = size
+	}
+}
+
+// DeliveryTimeout option sets how long Publish waits for room in the
+// buffer of a slow subscriber before the event is dropped for it. Zero
+// drops the event right away.
+func DeliveryTimeout(timeout time.Duration) Option {
+	return func(ps *InMemoryPubSub) {
+		ps.deliveryTimeout = timeout
+	}
+}
+
+// OnError option sets the function called when an event is dropped or a
+// handler fails. It is called from the publishing or the delivering
+// goroutine and must not block. By default errors are logged.
+func OnError(fn func(*DeliveryError)) Option {
+	return func(ps *InMemoryPubSub) {
+		ps.onError = fn
+	}
+}
+
 // NewInMemoryPubSub initializes an in-memory pubsub system.
-func NewInMemoryPubSub() *InMemoryPubSub {
-	return &InMemoryPubSub{subscribers: sync.Map{}}
+func NewInMemoryPubSub(options ...Option) *InMemoryPubSub {
+	ps := &InMemoryPubSub{
+		subscribers: newRegistry(),
+		log:         logger.Default(),
+		bufferSize:  64,
+	}
+	for _, option := range options {
+		option(ps)
+	}
+	return ps
 }
 
-// InMemoryPubSub implements the PubSub interface with an in-memory map.
+// InMemoryPubSub implements the PubSub interface with an in-memory
+// registry of subscribers indexed by topic. Every subscriber receives its
+// events in order on its own goroutine, so a slow subscriber delays
+// neither the publisher nor the other subscribers.
 type InMemoryPubSub struct {
-	subscribers sync.Map
+	subscribers     *registry
+	closed          int32
+	log             *logger.Logger
+	bufferSize      int
+	deliveryTimeout time.Duration
+	onError         func(*DeliveryError)
 }
 
-// Subscribe registers the given handler for the event.
+// Subscribe registers the given handler for the event. The event may
+// contain wildcards, each matching exactly one level: userUpdated.*
+// receives userUpdated.42 but neither userUpdated nor userUpdated.42.name.
 func (ps *InMemoryPubSub) Subscribe(event string, handler graphqlws.Handler) string {
-	s := newSubscriber(event, handler)
-	ps.subscribers.Store(s.ID, s)
+	s := newSubscriber(event, handler, ps.bufferSize)
+	ps.subscribers.add(s)
+	go ps.deliver(s)
 	return s.ID
 }
 
-// Publish publishes to all subscribers of the given event.
+// Publish publishes to all subscribers of the given event, including the
+// subscribers whose event matches it with wildcards.
 func (ps *InMemoryPubSub) Publish(event string, payload interface{}) {
-	ps.subscribers.Range(func(k, v interface{}) bool {
-		subscriber, ok := v.(Subscriber)
-		if !ok {
-			return true
+	ps.PublishWithStats(event, payload)
+}
+
+// PublishContext is like Publish but fails once the pubsub is closed.
+// Events dropped for slow subscribers are reported to the OnError
+// function, not returned.
+func (ps *InMemoryPubSub) PublishContext(ctx context.Context, event string, payload interface{}) error {
+	if atomic.LoadInt32(&ps.closed) == 1 {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ps.PublishWithStats(event, payload)
+	return nil
+}
+
+// PublishWithStats publishes to all subscribers of the given event and
+// reports for how many of them the event was queued. It returns before
+// the event is handled.
+func (ps *InMemoryPubSub) PublishWithStats(event string, payload interface{}) PublishStats {
+	var stats PublishStats
+	if atomic.LoadInt32(&ps.closed) == 1 {
+		return stats
+	}
+
+	metrics.Add("published", 1)
+	for _, subscriber := range ps.subscribers.match(event) {
+		stats.Matched++
+		if ps.enqueue(subscriber, payload) {
+			stats.Queued++
+			continue
 		}
-		if subscriber.Event == event {
-			if err := subscriber.Handler(payload); err != nil {
-				log.Println(err)
-				return true
+		stats.Dropped++
+		metrics.Add("dropped", 1)
+		ps.reportError(&DeliveryError{Event: event, SubscriberID: subscriber.ID, Err: ErrBufferFull})
+	}
+	return stats
+}
+
+// Unsubscribe removes the subscriber with given subID. Its queued events
+// are discarded.
+func (ps *InMemoryPubSub) Unsubscribe(subID string) {
+	if s, ok := ps.subscribers.remove(subID); ok {
+		s.stop()
+	}
+}
+
+// Close removes every subscriber. Events published afterwards are dropped.
+func (ps *InMemoryPubSub) Close() error {
+	atomic.StoreInt32(&ps.closed, 1)
+	for _, s := range ps.subscribers.all() {
+		ps.Unsubscribe(s.ID)
+	}
+	return nil
+}
+
+// enqueue queues payload for the subscriber, waiting up to the delivery
+// timeout while its buffer is full. It returns false when the event is
+// dropped.
+func (ps *InMemoryPubSub) enqueue(s *Subscriber, payload interface{}) bool {
+	select {
+	case s.events <- payload:
+		return true
+	case <-s.quit:
+		return false
+	default:
+	}
+	if ps.deliveryTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(ps.deliveryTimeout)
+	defer timer.Stop()
+	select {
+	case s.events <- payload:
+		return true
+	case <-s.quit:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// deliver runs the handler of the subscriber for each queued event until
+// it is unsubscribed.
+func (ps *InMemoryPubSub) deliver(s *Subscriber) {
+	for {
+		select {
+		case <-s.quit:
+			return
+		case payload := <-s.events:
+			if err := s.Handler(payload); err != nil {
+				metrics.Add("failed", 1)
+				ps.reportError(&DeliveryError{Event: s.Event, SubscriberID: s.ID, Err: err})
+				continue
 			}
+			metrics.Add("delivered", 1)
 		}
-		return true
-	})
+	}
 }
 
-// Unsubscribe removes the subscriber with given subID.
-func (ps *InMemoryPubSub) Unsubscribe(subID string) {
-	ps.subscribers.Delete(subID)
+func (ps *InMemoryPubSub) reportError(err *DeliveryError) {
+	if ps.onError != nil {
+		ps.onError(err)
+		return
+	}
+	ps.log.Warn("failed to deliver event", "event", err.Event,
+		"subscription_id", err.SubscriberID, "error", err.Err)
 }
 
 // Subscriber represents a client that wants to subscribe to an event.
@@ -53,13 +242,24 @@ type Subscriber struct {
 	ID      string
 	Event   string
 	Handler graphqlws.Handler
+
+	events   chan interface{}
+	quit     chan struct{}
+	stopOnce sync.Once
 }
 
-// newSubscriber creates a new instance of a Subscriber.
-func newSubscriber(event string, handler graphqlws.Handler) Subscriber {
-	return Subscriber{
+// newSubscriber creates a new instance of a Subscriber buffering up to
+// bufferSize events.
+func newSubscriber(event string, handler graphqlws.Handler, bufferSize int) *Subscriber {
+	return &Subscriber{
 		ID:      uuid.New().String(),
 		Event:   event,
 		Handler: handler,
+		events:  make(chan interface{}, bufferSize),
+		quit:    make(chan struct{}),
 	}
 }
+
+func (s *Subscriber) stop() {
+	s.stopOnce.Do(func() { close(s.quit) })
+}
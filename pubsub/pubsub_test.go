@@ -0,0 +1,229 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// subscribeSpread subscribes n subscribers spread evenly across the given
+// number of topics, e.g. user.updated.0 to user.updated.999.
+func subscribeSpread(b *testing.B, ps *InMemoryPubSub, n, topics int) {
+	b.Helper()
+	handler := func(interface{}) error { return nil }
+	for i := 0; i < n; i++ {
+		ps.Subscribe("user.updated."+strconv.Itoa(i%topics), handler)
+	}
+}
+
+func newBenchPubSub() *InMemoryPubSub {
+	return NewInMemoryPubSub(OnError(func(*DeliveryError) {}))
+}
+
+// blockingHandler signals each event it starts handling on entered and
+// then waits until release is closed.
+type blockingHandler struct {
+	entered chan interface{}
+	release chan struct{}
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{entered: make(chan interface{}, 16), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) handle(payload interface{}) error {
+	h.entered <- payload
+	<-h.release
+	return nil
+}
+
+// errorRecorder collects the errors reported to OnError.
+type errorRecorder struct {
+	mu     sync.Mutex
+	errors []*DeliveryError
+}
+
+func (r *errorRecorder) record(err *DeliveryError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, err)
+}
+
+func (r *errorRecorder) reported() []*DeliveryError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*DeliveryError(nil), r.errors...)
+}
+
+func waitFor(t *testing.T, ch <-chan interface{}) interface{} {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+		return nil
+	}
+}
+
+func TestSlowSubscriberBlocksNoOne(t *testing.T) {
+	const events = 4
+	ps := NewInMemoryPubSub(BufferSize(events), OnError(func(*DeliveryError) {}))
+	defer ps.Close()
+
+	slow := newBlockingHandler()
+	defer close(slow.release)
+	ps.Subscribe("user.updated.1", slow.handle)
+	fast := make(chan interface{}, events)
+	ps.Subscribe("user.updated.1", func(payload interface{}) error {
+		fast <- payload
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < events; i++ {
+			ps.Publish("user.updated.1", i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow subscriber")
+	}
+
+	for i := 0; i < events; i++ {
+		if v := waitFor(t, fast); v != i {
+			t.Fatalf("fast subscriber received %v, want %d", v, i)
+		}
+	}
+}
+
+func TestPublishDropsWhenBufferFull(t *testing.T) {
+	errs := &errorRecorder{}
+	ps := NewInMemoryPubSub(BufferSize(1), OnError(errs.record))
+	defer ps.Close()
+
+	h := newBlockingHandler()
+	defer close(h.release)
+	id := ps.Subscribe("user.updated.1", h.handle)
+
+	ps.Publish("user.updated.1", 1)
+	waitFor(t, h.entered)
+
+	if got := ps.PublishWithStats("user.updated.1", 2); got != (PublishStats{Matched: 1, Queued: 1}) {
+		t.Errorf("PublishWithStats() into the buffer = %+v", got)
+	}
+	if got := ps.PublishWithStats("user.updated.1", 3); got != (PublishStats{Matched: 1, Dropped: 1}) {
+		t.Errorf("PublishWithStats() into a full buffer = %+v", got)
+	}
+
+	reported := errs.reported()
+	if len(reported) != 1 {
+		t.Fatalf("reported %d errors, want 1", len(reported))
+	}
+	if err := reported[0]; err.Event != "user.updated.1" || err.SubscriberID != id || !errors.Is(err, ErrBufferFull) {
+		t.Errorf("reported %v, want ErrBufferFull for subscriber %s", err, id)
+	}
+}
+
+func TestPublishWaitsDeliveryTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	ps := NewInMemoryPubSub(BufferSize(1), DeliveryTimeout(timeout), OnError(func(*DeliveryError) {}))
+	defer ps.Close()
+
+	h := newBlockingHandler()
+	ps.Subscribe("user.updated.1", h.handle)
+	ps.Publish("user.updated.1", 1)
+	waitFor(t, h.entered)
+	ps.Publish("user.updated.1", 2)
+
+	start := time.Now()
+	if got := ps.PublishWithStats("user.updated.1", 3); got.Dropped != 1 {
+		t.Errorf("PublishWithStats() = %+v, want the event dropped", got)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("dropped after %v, want at least the %v timeout", elapsed, timeout)
+	}
+
+	// room made during the timeout queues the event
+	go func() {
+		time.Sleep(timeout / 5)
+		close(h.release)
+	}()
+	if got := ps.PublishWithStats("user.updated.1", 4); got.Queued != 1 {
+		t.Errorf("PublishWithStats() = %+v, want the event queued once there is room", got)
+	}
+}
+
+func TestPublishContextAfterClose(t *testing.T) {
+	ps := NewInMemoryPubSub()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ps.PublishContext(ctx, "user.updated.1", 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("PublishContext() with a canceled context error = %v", err)
+	}
+
+	ps.Subscribe("user.updated.1", func(interface{}) error { return nil })
+	ps.Close()
+	if err := ps.PublishContext(context.Background(), "user.updated.1", 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("PublishContext() after Close error = %v, want ErrClosed", err)
+	}
+	if got := ps.PublishWithStats("user.updated.1", 1); got != (PublishStats{}) {
+		t.Errorf("PublishWithStats() after Close = %+v, want nothing matched", got)
+	}
+}
+
+// BenchmarkPublish measures publishing to a single topic while 100k
+// subscribers are spread across an increasing number of topics. Publish
+// only visits the subscribers of the topic, so the cost drops as the
+// subscribers spread out.
+func BenchmarkPublish(b *testing.B) {
+	for _, topics := range []int{1000, 10000, 100000} {
+		b.Run("topics="+strconv.Itoa(topics), func(b *testing.B) {
+			ps := newBenchPubSub()
+			defer ps.Close()
+			subscribeSpread(b, ps, 100000, topics)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ps.Publish("user.updated."+strconv.Itoa(i%topics), i)
+			}
+		})
+	}
+}
+
+// BenchmarkPublishWildcard measures publishing when a wildcard subscriber
+// matches every topic alongside 100k subscribers on 10k topics.
+func BenchmarkPublishWildcard(b *testing.B) {
+	ps := newBenchPubSub()
+	defer ps.Close()
+	subscribeSpread(b, ps, 100000, 10000)
+	ps.Subscribe("user.*.*", func(interface{}) error { return nil })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ps.Publish("user.updated."+strconv.Itoa(i%10000), i)
+	}
+}
+
+// BenchmarkPublishUnmatched measures publishing to a topic without
+// subscribers while 100k subscribers are registered.
+func BenchmarkPublishUnmatched(b *testing.B) {
+	ps := newBenchPubSub()
+	defer ps.Close()
+	subscribeSpread(b, ps, 100000, 10000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ps.Publish("user.deleted."+strconv.Itoa(i), i)
+	}
+}
@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"strings"
+	"sync"
+)
+
+// Topics are hierarchical, with levels separated by dots, e.g.
+// userUpdated.42. A subscription topic may use * to match any single
+// level, e.g. userUpdated.* matches the events of every user.
+const (
+	topicSeparator = "."
+	topicWildcard  = "*"
+)
+
+// registry indexes subscribers by topic, so publishing only visits the
+// subscribers whose topic matches. It is safe for concurrent use.
+type registry struct {
+	mu   sync.RWMutex
+	root *topicNode
+	byID map[string]*Subscriber
+}
+
+// topicNode holds the subscribers of a topic level and its sub-levels.
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[string]*Subscriber
+}
+
+func newRegistry() *registry {
+	return &registry{
+		root: newTopicNode(),
+		byID: make(map[string]*Subscriber),
+	}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children:    make(map[string]*topicNode),
+		subscribers: make(map[string]*Subscriber),
+	}
+}
+
+// add registers s under its topic.
+func (r *registry) add(s *Subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node := r.root
+	for _, level := range strings.Split(s.Event, topicSeparator) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers[s.ID] = s
+	r.byID[s.ID] = s
+}
+
+// remove unregisters the subscriber with the given ID and returns it.
+func (r *registry) remove(id string) (*Subscriber, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.byID[id]
+	if !ok {
+		return nil, false
+	}
+	delete(r.byID, id)
+
+	// walk down to the subscriber, then prune the levels left empty
+	levels := strings.Split(s.Event, topicSeparator)
+	path := make([]*topicNode, 0, len(levels)+1)
+	path = append(path, r.root)
+	for _, level := range levels {
+		path = append(path, path[len(path)-1].children[level])
+	}
+	delete(path[len(path)-1].subscribers, id)
+	for i := len(path) - 1; i > 0; i-- {
+		node := path[i]
+		if len(node.subscribers) > 0 || len(node.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+	return s, true
+}
+
+// match returns the subscribers whose topic matches the published topic.
+func (r *registry) match(topic string) []*Subscriber {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var matched []*Subscriber
+	var walk func(node *topicNode, levels []string)
+	walk = func(node *topicNode, levels []string) {
+		if len(levels) == 0 {
+			for _, s := range node.subscribers {
+				matched = append(matched, s)
+			}
+			return
+		}
+		if child, ok := node.children[levels[0]]; ok {
+			walk(child, levels[1:])
+		}
+		if child, ok := node.children[topicWildcard]; ok && levels[0] != topicWildcard {
+			walk(child, levels[1:])
+		}
+	}
+	walk(r.root, strings.Split(topic, topicSeparator))
+	return matched
+}
+
+// all returns every subscriber.
+func (r *registry) all() []*Subscriber {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	subscribers := make([]*Subscriber, 0, len(r.byID))
+	for _, s := range r.byID {
+		subscribers = append(subscribers, s)
+	}
+	return subscribers
+}
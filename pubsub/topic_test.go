@@ -0,0 +1,89 @@
+package pubsub
+
+import (
+	"sort"
+	"testing"
+)
+
+func subscriberEvents(subscribers []*Subscriber) []string {
+	events := make([]string, len(subscribers))
+	for i, s := range subscribers {
+		events[i] = s.Event
+	}
+	sort.Strings(events)
+	return events
+}
+
+func TestRegistryMatch(t *testing.T) {
+	r := newRegistry()
+	for _, event := range []string{
+		"user.updated.42",
+		"user.updated.7",
+		"user.updated.*",
+		"user.*.42",
+		"user.*",
+		"*",
+	} {
+		r.add(newSubscriber(event, nil, 0))
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{topic: "user.updated.42", want: []string{"user.*.42", "user.updated.*", "user.updated.42"}},
+		{topic: "user.updated.7", want: []string{"user.updated.*", "user.updated.7"}},
+		{topic: "user.deleted.42", want: []string{"user.*.42"}},
+		{topic: "user.updated", want: []string{"user.*"}},
+		{topic: "user", want: []string{"*"}},
+		{topic: "user.updated.42.name", want: []string{}},
+		{topic: "order.created.1", want: []string{}},
+		// a published * is a literal level, not a wildcard
+		{topic: "user.updated.*", want: []string{"user.updated.*"}},
+		{topic: "user.*", want: []string{"user.*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			got := subscriberEvents(r.match(tt.topic))
+			if len(got) != len(tt.want) {
+				t.Fatalf("match(%q) = %q, want %q", tt.topic, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("match(%q) = %q, want %q", tt.topic, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryRemovePrunes(t *testing.T) {
+	r := newRegistry()
+	a := newSubscriber("user.*.42", nil, 0)
+	b := newSubscriber("user.updated.42", nil, 0)
+	r.add(a)
+	r.add(b)
+
+	if _, ok := r.remove(a.ID); !ok {
+		t.Fatal("remove() = false for a registered subscriber")
+	}
+	if _, ok := r.remove(a.ID); ok {
+		t.Error("remove() = true for a removed subscriber")
+	}
+	user := r.root.children["user"]
+	if _, ok := user.children[topicWildcard]; ok {
+		t.Error("remove() left the empty wildcard level")
+	}
+	if got := r.match("user.updated.42"); len(got) != 1 || got[0] != b {
+		t.Errorf("match() after remove = %v, want only %s", subscriberEvents(got), b.Event)
+	}
+
+	r.remove(b.ID)
+	if len(r.root.children) != 0 {
+		t.Errorf("remove() of the last subscriber left levels %v", r.root.children)
+	}
+	if len(r.all()) != 0 {
+		t.Errorf("all() = %d subscribers, want 0", len(r.all()))
+	}
+}